@@ -0,0 +1,90 @@
+package feed
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// pageBackups is how many previous versions of each html file are kept as <name>.bak1 (newest) to <name>.bakN
+const pageBackups = 3
+
+// backupName returns the name of the nth newest backup of fileName
+func backupName(fileName string, n int) string {
+	return fmt.Sprintf("%s.bak%d", fileName, n)
+}
+
+// writeFileAtomically makes write's output the new content of fileName without ever leaving it half written,
+// which matters since html files are often read by Google Drive or Dropbox while news is running.
+// Output goes to a hidden temp file in the same directory, which is synced to disk and then renamed over fileName.
+// Unless backups is zero, the previous content of fileName is first kept as the newest of that many rotating backups.
+// If anything fails, fileName is left as it was.
+func writeFileAtomically(fileName string, backups int, write func(w io.Writer) error) (err error) {
+	dir, base := filepath.Split(filepath.Clean(fileName))
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = write(tmp); err != nil {
+		return err
+	}
+	// Temp files are only readable by their owner, so keep the mode of the file being replaced
+	mode := os.FileMode(0644)
+	if stat, err := os.Stat(fileName); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = rotateBackups(fileName, backups); err != nil {
+		return fmt.Errorf("could not back up %s: %s", fileName, err)
+	}
+	if err = os.Rename(tmp.Name(), fileName); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// rotateBackups shifts the existing backups of fileName one place, dropping the oldest, and copies fileName to the first.
+// fileName itself is never moved, so it's always there for readers.
+func rotateBackups(fileName string, backups int) error {
+	if backups < 1 || !fileExists(fileName) {
+		return nil
+	}
+	for n := backups - 1; n >= 1; n-- {
+		if !fileExists(backupName(fileName, n)) {
+			continue
+		}
+		if err := os.Rename(backupName(fileName, n), backupName(fileName, n+1)); err != nil {
+			return err
+		}
+	}
+	return copyFileContents(fileName, backupName(fileName, 1))
+}
+
+// syncDir makes renames in dir durable. It's best effort since some systems, like Windows, can't sync directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
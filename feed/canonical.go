@@ -0,0 +1,203 @@
+package feed
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// trackingParams are query parameters added for analytics. They never change which article a URL points to.
+// Parameters starting with utm_ are stripped too.
+var trackingParams = []string{"fbclid", "gclid", "dclid", "gclsrc", "msclkid", "yclid", "mc_cid", "mc_eid", "igshid", "mkt_tok",
+	"_ga", "_gl", "_hsenc", "_hsmi", "ref_src", "ref_url", "cmpid", "ocid"}
+
+// URLRule tells how to clean URLs of a domain and its subdomains, on top of stripping tracking parameters
+type URLRule struct {
+	// KeepParams, when set, are the only query parameters kept
+	KeepParams []string
+	// StripParams are removed from the query
+	StripParams []string
+}
+
+// defaultURLRules are used unless replaced with Aggregator.SetURLRules()
+var defaultURLRules = map[string]URLRule{
+	"youtube.com": {KeepParams: []string{"v", "list", "t"}},
+}
+
+// ParseURLRules reads per-domain URL rules, one domain per line followed by keep= and/or strip= lists of query parameters:
+//
+//	# Lines starting with # are comments
+//	youtube.com keep=v,list,t
+//	example.com strip=ref,source
+func ParseURLRules(r io.Reader) (map[string]URLRule, error) {
+	rules := make(map[string]URLRule)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		domain := strings.TrimPrefix(strings.ToLower(fields[0]), "www.")
+		rule := URLRule{}
+		for _, field := range fields[1:] {
+			name, list, found := strings.Cut(field, "=")
+			switch {
+			case found && name == "keep":
+				rule.KeepParams = append(rule.KeepParams, strings.Split(list, ",")...)
+			case found && name == "strip":
+				rule.StripParams = append(rule.StripParams, strings.Split(list, ",")...)
+			default:
+				return nil, fmt.Errorf("line %d: expected keep=param1,param2 or strip=param1,param2 but found %q", line, field)
+			}
+		}
+		rules[domain] = rule
+	}
+	return rules, scanner.Err()
+}
+
+// SetURLRules adds per-domain rules for cleaning item URLs, replacing the default ones for the same domains.
+// Items already in the html files are then recognized under the new rules, rebuilding the seen index, unless the
+// rules didn't change. Rules known before the html files are loaded are better given to NewWithRules().
+func (agg *Aggregator) SetURLRules(rules map[string]URLRule) error {
+	previous := agg.rulesHash()
+	agg.urlRules = withDefaultURLRules(rules)
+	if agg.rulesHash() == previous {
+		return nil
+	}
+	return agg.loadFeedsAndItemsFromHTMLFiles()
+}
+
+// withDefaultURLRules returns rules along with the default ones for other domains
+func withDefaultURLRules(rules map[string]URLRule) map[string]URLRule {
+	merged := make(map[string]URLRule)
+	for domain, rule := range defaultURLRules {
+		merged[domain] = rule
+	}
+	for domain, rule := range rules {
+		merged[domain] = rule
+	}
+	return merged
+}
+
+func (agg *Aggregator) rules() map[string]URLRule {
+	if agg.urlRules == nil {
+		return defaultURLRules
+	}
+	return agg.urlRules
+}
+
+// cleanURL removes tracking parameters and unwraps AMP URLs, giving a URL that still works and is nicer to share.
+// Examples:
+// https://www.google.com/amp/s/example.com/news/1 -> https://example.com/news/1
+// https://example-com.cdn.ampproject.org/c/s/example.com/news/1 -> https://example.com/news/1
+// https://example.com/news/1/?utm_source=rss -> https://example.com/news/1/
+// Non http(s) URLs and URLs that can't be parsed are returned as is.
+func cleanURL(rawURL string, rules map[string]URLRule) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" || (!strings.EqualFold(u.Scheme, "http") && !strings.EqualFold(u.Scheme, "https")) {
+		return rawURL
+	}
+	u = unwrapAMP(u)
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && u.Port() == "80") || (u.Scheme == "https" && u.Port() == "443") {
+		u.Host = u.Hostname()
+	}
+	rule := ruleFor(u.Hostname(), rules)
+	kept := make([]string, 0)
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if param == "" || isStrippedParam(key, rule) {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	u.ForceQuery = false
+	return u.String()
+}
+
+// canonicalKey is what tells whether two URLs point to the same article. On top of cleanURL it disregards
+// http versus https, www., trailing slashes, fragments, the order of query parameters and the /amp path suffix and amp
+// parameter many sites use for the AMP version of an article.
+// It's only used to identify items, see isKnown(). Links in html files keep their cleaned URL, since on other sites
+// those could be part of the address, like https://github.com/ampproject/amp.
+func canonicalKey(rawURL string, rules map[string]URLRule) string {
+	cleaned := cleanURL(rawURL, rules)
+	u, err := url.Parse(cleaned)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return cleaned
+	}
+	u.Scheme = "https"
+	u.Host = strings.TrimPrefix(u.Host, "www.")
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/amp")
+	u.RawPath = ""
+	u.Fragment = ""
+	u.RawFragment = ""
+	query := u.Query()
+	query.Del("amp")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// unwrapAMP returns the original article of Google AMP viewer and AMP cache URLs, or u itself for any other URL
+func unwrapAMP(u *url.URL) *url.URL {
+	host := strings.ToLower(u.Hostname())
+	path := u.EscapedPath()
+	switch {
+	case (host == "www.google.com" || host == "google.com") && strings.HasPrefix(path, "/amp/"):
+		path = strings.TrimPrefix(path, "/amp/")
+	case strings.HasSuffix(host, ".cdn.ampproject.org") && len(path) > 3 && strings.Contains("cvi", path[1:2]) && path[2] == '/':
+		path = path[3:]
+	default:
+		return u
+	}
+	scheme := "http://"
+	if strings.HasPrefix(path, "s/") {
+		scheme, path = "https://", strings.TrimPrefix(path, "s/")
+	}
+	original, err := url.Parse(scheme + path)
+	if err != nil || original.Host == "" {
+		return u
+	}
+	original.RawQuery = u.RawQuery
+	original.Fragment = u.Fragment
+	return original
+}
+
+// ruleFor finds the rule of host's most specific domain
+func ruleFor(host string, rules map[string]URLRule) URLRule {
+	host = strings.TrimPrefix(host, "www.")
+	for domain := host; domain != ""; {
+		if rule, found := rules[domain]; found {
+			return rule
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			break
+		}
+		domain = parent
+	}
+	return URLRule{}
+}
+
+func isStrippedParam(key string, rule URLRule) bool {
+	if strings.HasPrefix(strings.ToLower(key), "utm_") || contains(trackingParams, key) || contains(rule.StripParams, key) {
+		return true
+	}
+	return len(rule.KeepParams) > 0 && !contains(rule.KeepParams, key)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
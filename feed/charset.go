@@ -0,0 +1,83 @@
+package feed
+
+import (
+	"bytes"
+	"mime"
+	"regexp"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// xmlDeclarationEncoding matches the encoding attribute of an XML declaration such as <?xml version="1.0" encoding="ISO-8859-1"?>
+var xmlDeclarationEncoding = regexp.MustCompile(`^(\s*<\?xml[^>]*?\sencoding\s*=\s*)["']([A-Za-z0-9._:-]+)["']`)
+
+// decodeToUTF8 transcodes a feed to UTF-8 so it can be cleaned and parsed as such.
+// The encoding is taken from, in order: a byte order mark, the charset of contentType (if it doesn't contradict the content),
+// the XML declaration, and finally UTF-8 if the content is valid UTF-8 or Windows-1252 if it isn't.
+// The XML declaration is rewritten to say UTF-8 so parsers don't decode the content a second time.
+func decodeToUTF8(content []byte, contentType string) []byte {
+	enc, name := encodingOf(content, contentType)
+	if name != "utf-8" {
+		if decoded, err := enc.NewDecoder().Bytes(content); err == nil {
+			content = decoded
+		}
+	}
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	return xmlDeclarationEncoding.ReplaceAll(content, []byte(`${1}"UTF-8"`))
+}
+
+// byteOrderMarks maps the byte order marks feeds may start with to their encoding
+var byteOrderMarks = []struct {
+	bom   string
+	label string
+}{
+	{"\xef\xbb\xbf", "utf-8"},
+	{"\xfe\xff", "utf-16be"},
+	{"\xff\xfe", "utf-16le"},
+}
+
+func encodingOf(content []byte, contentType string) (enc encoding.Encoding, name string) {
+	for _, mark := range byteOrderMarks {
+		if bytes.HasPrefix(content, []byte(mark.bom)) {
+			return charset.Lookup(mark.label)
+		}
+	}
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		if enc, name := charset.Lookup(params["charset"]); enc != nil && (name != "utf-8" || utf8.Valid(content)) {
+			return enc, name
+		}
+	}
+	if match := xmlDeclarationEncoding.FindSubmatch(content); match != nil {
+		if enc, name := charset.Lookup(string(match[2])); enc != nil && (name != "utf-8" || utf8.Valid(content)) {
+			return enc, name
+		}
+	}
+	if utf8.Valid(content) {
+		return encoding.Nop, "utf-8"
+	}
+	return charmap.Windows1252, "windows-1252"
+}
+
+// isXMLChar reports whether r may appear in an XML 1.0 document. See https://www.w3.org/TR/xml/#charsets
+func isXMLChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		(r >= 0x20 && r <= 0xD7FF) ||
+		(r >= 0xE000 && r <= 0xFFFD) ||
+		(r >= 0x10000 && r <= 0x10FFFF)
+}
+
+// decodeHTMLToUTF8 transcodes a web page to UTF-8 following, in order, its byte order mark, the charset of contentType
+// and its <meta charset>. Pages that are valid UTF-8 are left alone.
+func decodeHTMLToUTF8(page []byte, contentType string) []byte {
+	enc, name, _ := charset.DetermineEncoding(page, contentType)
+	if name == "utf-8" || utf8.Valid(page) {
+		return page
+	}
+	if decoded, err := enc.NewDecoder().Bytes(page); err == nil {
+		return decoded
+	}
+	return page
+}
@@ -0,0 +1,203 @@
+package feed
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Related is another feed's item about the same story as the item it's attached to.
+// It's rendered as a small tag next to the item instead of an entry of its own.
+type Related struct {
+	Title string
+	// URL is the discussion of the other feed's item if it has one, since the article is the same
+	URL  string
+	Tag  string
+	Feed string
+}
+
+// minSimilarTitleWords is how many significant words two titles must share before they are considered the same story
+const minSimilarTitleWords = 3
+
+// minTitleSimilarity is the share of significant words two titles must have in common to be considered the same story
+const minTitleSimilarity = 0.6
+
+// titleStopWords are too common to tell stories apart
+var titleStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "from": true, "that": true, "this": true, "are": true, "was": true,
+	"has": true, "have": true, "its": true, "but": true, "not": true, "you": true, "your": true, "after": true, "over": true,
+	"into": true, "about": true, "how": true, "why": true, "what": true, "new": true, "will": true, "says": true,
+}
+
+// storyIndex finds which item of agg.Items a new item is about the same story as, without parsing every URL of
+// index.html for every new item. Items are referred to by their position from the bottom of agg.Items, which
+// stays the same while new items are prepended.
+type storyIndex struct {
+	agg *Aggregator
+	// byURL maps canonical URLs of items and their related items to positions
+	byURL map[string][]int
+	// byGUID maps guidKey() of items to positions
+	byGUID map[string]int
+	// words caches titleWords() of items by position
+	words map[int]map[string]bool
+}
+
+func (agg *Aggregator) newStoryIndex() *storyIndex {
+	index := &storyIndex{agg: agg, byURL: make(map[string][]int), byGUID: make(map[string]int), words: make(map[int]map[string]bool)}
+	for position := range agg.Items {
+		index.add(position)
+	}
+	return index
+}
+
+// add indexes the URLs of the item at position and those of its related items. It's called again after relating items.
+func (index *storyIndex) add(position int) {
+	item := index.item(position)
+	if item.GUID != "" {
+		index.byGUID[guidKey(*item)] = position
+	}
+	delete(index.words, position)
+	URLs := []string{item.URL, item.DiscussionURL}
+	for _, related := range item.Related {
+		URLs = append(URLs, related.URL)
+	}
+	for _, URL := range URLs {
+		if URL == "" {
+			continue
+		}
+		key := canonicalKey(URL, index.agg.rules())
+		if positions := index.byURL[key]; len(positions) == 0 || positions[len(positions)-1] != position {
+			index.byURL[key] = append(positions, position)
+		}
+	}
+}
+
+func (index *storyIndex) item(position int) *Item {
+	return &index.agg.Items[len(index.agg.Items)-1-position]
+}
+
+// entryOf returns the position of item's own entry, the one from the same feed with the same GUID or URL, or -1 if
+// there's none such as when the item was related to another feed's story or moved to an older page.
+func (index *storyIndex) entryOf(item Item) int {
+	if item.GUID != "" {
+		if position, found := index.byGUID[guidKey(item)]; found {
+			return position
+		}
+	}
+	for _, URL := range []string{item.URL, item.DiscussionURL} {
+		if URL == "" {
+			continue
+		}
+		for _, position := range index.byURL[canonicalKey(URL, index.agg.rules())] {
+			if existing := index.item(position); existing.Feed == item.Feed && (item.GUID == "" || existing.GUID == "" || existing.GUID == item.GUID) {
+				return position
+			}
+		}
+	}
+	return -1
+}
+
+// storyOf returns the position of the item which is about the same story as item, or -1 if there's none.
+// Items of the same feed are never grouped. Stories are the same if they share a URL or discussion URL, or failing that
+// if their titles are similar and the existing item was first seen within agg.ClusterWindow.
+// Items related to a story count as part of it.
+func (index *storyIndex) storyOf(item Item, now time.Time) int {
+	for _, URL := range []string{item.URL, item.DiscussionURL} {
+		if URL == "" {
+			continue
+		}
+		for _, position := range index.byURL[canonicalKey(URL, index.agg.rules())] {
+			if index.item(position).Feed != item.Feed {
+				return position
+			}
+		}
+	}
+	if index.agg.ClusterWindow <= 0 {
+		return -1
+	}
+	words := titleWords(item.Title)
+	for i := range index.agg.Items {
+		position := len(index.agg.Items) - 1 - i
+		existing := index.item(position)
+		if existing.Feed == item.Feed || existing.FirstSeen.IsZero() || now.Sub(existing.FirstSeen) > index.agg.ClusterWindow {
+			continue
+		}
+		if _, found := index.words[position]; !found {
+			index.words[position] = titleWords(existing.Title)
+		}
+		if similarTitles(words, index.words[position]) {
+			return position
+		}
+		for _, related := range existing.Related {
+			if similarTitles(words, titleWords(related.Title)) {
+				return position
+			}
+		}
+	}
+	return -1
+}
+
+// relate attaches item to story as a Related, unless item's feed is already part of the story
+func (story *Item) relate(item Item) bool {
+	if story.Feed == item.Feed {
+		return false
+	}
+	for _, related := range story.Related {
+		if related.Feed == item.Feed {
+			return false
+		}
+	}
+	item.SetTag()
+	URL := item.URL
+	if item.DiscussionURL != "" {
+		URL = item.DiscussionURL
+	}
+	story.Related = append(story.Related, Related{Title: item.Title, URL: URL, Tag: item.Tag, Feed: item.Feed})
+	return true
+}
+
+// refresh updates the entry with what its feed now says about it, if the title changed or the update time is newer.
+// With mark, RefreshedAt is set so the entry is labeled as updated. Returns whether anything changed.
+func (entry *Item) refresh(fetched Item, now time.Time, mark bool) bool {
+	newer := !fetched.UpdatedAt.IsZero() && fetched.UpdatedAt.After(entry.UpdatedAt)
+	if fetched.Title == entry.Title && !newer {
+		return false
+	}
+	entry.Title = fetched.Title
+	entry.Summary = fetched.Summary
+	if newer {
+		entry.UpdatedAt = fetched.UpdatedAt
+	}
+	if fetched.Author != "" {
+		entry.Author = fetched.Author
+	}
+	if mark {
+		entry.RefreshedAt = now
+	}
+	return true
+}
+
+// titleWords returns the lowercased words of title which are long and uncommon enough to tell stories apart
+func titleWords(title string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len([]rune(word)) >= 3 && !titleStopWords[word] {
+			words[word] = true
+		}
+	}
+	return words
+}
+
+// similarTitles compares the significant words of two titles by how many they share out of all of them (Jaccard index)
+func similarTitles(a, b map[string]bool) bool {
+	shared := 0
+	for word := range a {
+		if b[word] {
+			shared++
+		}
+	}
+	all := len(a) + len(b) - shared
+	return shared >= minSimilarTitleWords && float64(shared)/float64(all) >= minTitleSimilarity
+}
@@ -0,0 +1,108 @@
+package feed
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// conflictCopyName matches copies of index.html made by sync clients when it was changed on two machines at once, such as
+// "index (1).html" from Google Drive, "index (Jane's conflicted copy 2023-06-02).html" from Dropbox
+// and "index.sync-conflict-20230602-120000-ABCDEFG.html" from Syncthing
+var conflictCopyName = regexp.MustCompile(`^index( ?\([^)]*\)|\.sync-conflict-[^.]*)\.html$`)
+
+// conflictCopies returns the conflict copies of index.html in dir, sorted by name
+func conflictCopies(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	copies := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() && conflictCopyName.MatchString(entry.Name()) {
+			copies = append(copies, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return copies
+}
+
+// mergeConflictCopies adds feeds and news found only in conflict copies of index.html to the given contents of index.html
+// and saves it, so feeds added on another machine aren't lost to whichever copy the sync client picked.
+// Feeds in both keep what index.html says about them. Merged copies are moved to the conflicts directory.
+func (agg *Aggregator) mergeConflictCopies(indexFile string, items []Item, feeds map[string]string, feedInfos map[string]*FeedInfo) ([]Item, error) {
+	copies := conflictCopies(agg.Directory)
+	if len(copies) == 0 {
+		return items, nil
+	}
+	archiveDir := filepath.Join(agg.Directory, "conflicts")
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return items, fmt.Errorf("could not create %s for sync conflict copies: %s", archiveDir, err)
+	}
+	merged := make([]string, 0)
+	for _, copyFile := range copies {
+		copyItems, copyFeeds, copyFeedInfos, err := loadFromFile(copyFile)
+		if err != nil {
+			agg.log.Errorf("could not merge sync conflict copy %s: %s", copyFile, err)
+			continue
+		}
+		addedFeeds := 0
+		for URL, title := range copyFeeds {
+			if _, found := feeds[URL]; found {
+				continue
+			}
+			feeds[URL] = title
+			if info, found := copyFeedInfos[URL]; found {
+				feedInfos[URL] = info
+			}
+			addedFeeds++
+		}
+		before := len(items)
+		items = agg.mergeItems(items, copyItems)
+		agg.log.Warnf("%s : sync conflict copy of index.html, merged %d feeds and %d news from it", copyFile, addedFeeds, len(items)-before)
+		merged = append(merged, copyFile)
+	}
+	if len(merged) == 0 {
+		return items, nil
+	}
+	if err := agg.saveIndex(indexFile, items, feeds, feedInfos); err != nil {
+		return items, fmt.Errorf("could not save sync conflict copies merged into %s: %s", indexFile, err)
+	}
+	for _, copyFile := range merged {
+		archived := filepath.Join(archiveDir, agg.now().Format("20060102-150405")+" "+filepath.Base(copyFile))
+		if err := os.Rename(copyFile, archived); err != nil {
+			agg.log.Errorf("could not move merged sync conflict copy %s to %s: %s", copyFile, archiveDir, err)
+			continue
+		}
+		agg.log.Infof("%s : moved to %s", copyFile, archived)
+	}
+	return items, nil
+}
+
+// mergeItems adds the items of extra that aren't known yet, each placed before the first item seen earlier than it,
+// so news from both copies end up in the order they arrived. Items without FirstSeen go to the bottom.
+// Copies are usually older than the latest page split, so their news are often in pageN.html by now.
+func (agg *Aggregator) mergeItems(items []Item, extra []Item) []Item {
+	// index.html may hold news the seen index doesn't know about yet, such as when the sync client brought it over
+	URLs := make(map[string]bool)
+	for _, item := range items {
+		URLs[canonicalKey(item.URL, agg.rules())] = true
+	}
+	for _, item := range extra {
+		key := canonicalKey(item.URL, agg.rules())
+		if URLs[key] || agg.isKnown(item) {
+			continue
+		}
+		URLs[key] = true
+		position := len(items)
+		for i := range items {
+			if !item.FirstSeen.IsZero() && items[i].FirstSeen.Before(item.FirstSeen) {
+				position = i
+				break
+			}
+		}
+		items = append(items[:position], append([]Item{item}, items[position:]...)...)
+		agg.markKnown(item)
+	}
+	return items
+}
@@ -0,0 +1,78 @@
+package feed
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// feedMIMETypes are the <link rel="alternate"> types web pages use to advertise their feeds
+var feedMIMETypes = []string{"application/rss+xml", "application/atom+xml", "application/feed+json", "application/json"}
+
+// commonFeedPaths are probed when a web page doesn't advertise its feed
+var commonFeedPaths = []string{"/feed", "/feed/", "/rss", "/rss.xml", "/atom.xml", "/feed.xml", "/index.xml", "/feed.json"}
+
+// looksLikeHTML tells web pages apart from feeds, which are sniffed as text/xml or text/plain
+func looksLikeHTML(contents []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(contents), "text/html")
+}
+
+// discoverFeed is used when a feed URL turns out to be a web page, usually a blog's homepage pasted in index.html.
+// It tries feeds advertised by the page through <link rel="alternate"> and, failing that, common feed paths on the same site.
+// Returns the URL of the first candidate that parses as a feed along with its fetch result, or an empty URL if none does.
+func (agg *Aggregator) discoverFeed(pageURL string, page []byte) (feedURL string, result fetchResult) {
+	for _, candidate := range feedCandidates(pageURL, page) {
+		info := FeedInfo{}
+		body, contentType, err := agg.fetch(candidate, &info)
+		if err != nil {
+			agg.log.Debugf("%s : feed candidate %s failed: %s", pageURL, candidate, err)
+			continue
+		}
+		items, hints, err := agg.parseXML(decodeToUTF8(body, contentType))
+		if err != nil {
+			agg.log.Debugf("%s : feed candidate %s failed: %s", pageURL, candidate, err)
+			continue
+		}
+		agg.log.Infof("%s : is a web page, found its feed at %s", pageURL, candidate)
+		return candidate, fetchResult{items: items, hints: hints, info: info}
+	}
+	return "", fetchResult{}
+}
+
+// feedCandidates lists absolute URLs that may hold the feed of the web page at pageURL, most likely first
+func feedCandidates(pageURL string, page []byte) []string {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil
+	}
+	candidates := make([]string, 0)
+	seen := map[string]bool{pageURL: true}
+	add := func(href string) {
+		u, err := base.Parse(strings.TrimSpace(href))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || seen[u.String()] {
+			return
+		}
+		seen[u.String()] = true
+		candidates = append(candidates, u.String())
+	}
+	if doc, err := goquery.NewDocumentFromReader(bytes.NewReader(page)); err == nil {
+		doc.Find(`link[rel~="alternate"][href]`).Each(func(i int, s *goquery.Selection) {
+			linkType := strings.ToLower(strings.TrimSpace(s.AttrOr("type", "")))
+			for _, feedType := range feedMIMETypes {
+				if linkType == feedType {
+					add(s.AttrOr("href", ""))
+				}
+			}
+		})
+	}
+	if len(candidates) > 0 {
+		return candidates
+	}
+	for _, path := range commonFeedPaths {
+		add(path)
+	}
+	return candidates
+}
@@ -1,13 +1,14 @@
 package feed
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,7 +17,6 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/corpix/uarand"
 	"github.com/kennygrant/sanitize"
 )
 
@@ -25,6 +25,26 @@ type Item struct {
 	Title string
 	URL   string
 	Tag   string
+	// PublishedAt and UpdatedAt are as reported by the feed. Zero if the feed didn't say.
+	PublishedAt time.Time
+	UpdatedAt   time.Time
+	Author      string
+	// Summary is the item's description as plain text, shortened to a tooltip's worth
+	Summary string
+	// Feed is the URL of the feed this item came from
+	Feed string
+	// FirstSeen is when this item was first fetched by us
+	FirstSeen time.Time
+	// DiscussionURL is where the item is discussed, such as its Hacker News or Reddit thread. Empty if that's URL itself.
+	DiscussionURL string
+	// DiscussionFirst makes DiscussionURL the main link of the item, for feeds whose readers care more about the discussion
+	DiscussionFirst bool
+	// GUID is the item's <guid> or <id>, unique within its feed. Empty if the feed has none or they can't be trusted.
+	GUID string
+	// Related are other feeds' items about the same story
+	Related []Related
+	// RefreshedAt is when the feed last changed the item's title or update time, if Aggregator.MarkRefreshed is on
+	RefreshedAt time.Time
 }
 
 // Aggregator is the core structure than fetches feeds and saves them to html. See Aggregator.Update()
@@ -32,38 +52,108 @@ type Aggregator struct {
 	Items []Item // Ordered from newest to oldest. Always prepend new items.
 	// Feeds is a map of URLs -> Titles for feeds. This needs to be stored somewhere so reader knows from where to fetch news
 	Feeds map[string]string
-	// We store item URLs so we know when something new appears
-	KnownItems   map[string]bool
-	Directory    string
-	URLFetcher   func(url string) ([]byte, error)
+	// FeedInfos maps feed URLs to their bookkeeping. Entries may be missing for feeds that were never fetched
+	FeedInfos map[string]*FeedInfo
+	// known stores item identities so we know when something new appears: canonical URLs, see canonicalKey(),
+	// and GUIDs scoped to their feed, see guidKey()
+	known     *seenIndex
+	Directory string
+	// Fetcher retrieves feed contents
+	Fetcher      Fetcher
 	pages        int
 	ItemsPerPage int
 	NextPage     int
-	log          *logrus.Logger
+	// Workers is how many feeds are fetched concurrently. Requests to the same host are still serialized by the URL fetcher.
+	Workers int
+	// FailureBackoff is how long to wait before retrying a feed after its first failure. It doubles on each consecutive failure.
+	FailureBackoff time.Duration
+	// MaxFailures is how many consecutive failures disable a feed. Zero means feeds are never disabled.
+	MaxFailures int
+	// DefaultInterval is how often feeds without refresh hints are fetched.
+	// Feeds with hints such as RSS <ttl> are fetched as the publisher asks, but never more often than MinInterval nor less often than MaxInterval.
+	DefaultInterval time.Duration
+	MinInterval     time.Duration
+	MaxInterval     time.Duration
+	// Chronological sorts the items found during an update by date before they land on top of index.html.
+	// Otherwise they are grouped by feed in the order feeds were fetched.
+	Chronological bool
+	// Clock tells the time, time.Now by default. Replayed updates are given the time of the recording instead.
+	Clock func() time.Time
+	// ClusterWindow is how long after an item was first seen other feeds' items with similar titles are attached to it
+	// instead of getting entries of their own. Items sharing a URL are always grouped. Zero disables title similarity.
+	ClusterWindow time.Duration
+	// RefreshKnownItems updates the title, summary and update time of items already in index.html when their feed
+	// reports a new title or a newer update time. Items stay where they are.
+	RefreshKnownItems bool
+	// MarkRefreshed labels items refreshed by RefreshKnownItems as updated in the html files
+	MarkRefreshed bool
+	// Shuffle fetches feeds in random order. Replayed updates turn it off so they produce the same index.html every time.
+	Shuffle bool
+	// SeenExpiry forgets news not seen for that long, neither in index.html nor in their feed, so the seen index
+	// doesn't grow forever. They show up again if their feed brings them back. Zero never forgets.
+	SeenExpiry time.Duration
+	// ReadOnly instances fetch feeds and log what's new but never write to Directory,
+	// so they can run alongside the instance holding it. See NewWithLock().
+	ReadOnly bool
+	// urlRules clean item URLs of specific domains, see SetURLRules()
+	urlRules map[string]URLRule
+	// indexBackedUp is set once index.html was backed up during the current update, see saveIndex()
+	indexBackedUp bool
+	// lock keeps other instances from writing to Directory, nil if ReadOnly
+	lock *dirLock
+	log  *logrus.Logger
 }
 
 // New creates an Aggregator with default URL fetcher
 func New(directory string) (*Aggregator, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
 	log := logrus.New()
-	return NewWithCustom(log, directory, 1000, MakeURLFetcher(log, 30*time.Second, client))
+	return NewWithCustom(log, directory, 1000, MakeSourceFetcher(log, client.Timeout, MakeURLFetcher(log, 30*time.Second, client)))
 }
 
-// NewWithCustom allows for creating customized Aggregators such as custom URL fetcher for testing or with custom http.client
+// NewWithCustom allows for creating customized Aggregators such as custom Fetcher for testing or with custom http.client
 // minDomainRequestInterval is the minimum time we must wait between calls to same domain. Aka debouncer. For cases like multiple reddit.com feeds.
-func NewWithCustom(log *logrus.Logger, directory string, itemsPerPage int, URLFetcher func(URL string) ([]byte, error)) (*Aggregator, error) {
+// The directory is locked for this instance until Close() is called, see NewWithLock().
+func NewWithCustom(log *logrus.Logger, directory string, itemsPerPage int, fetcher Fetcher) (*Aggregator, error) {
+	return NewWithLock(log, directory, itemsPerPage, fetcher, Exclusive)
+}
+
+// NewWithLock is NewWithCustom with a choice of how to share the directory with other instances, which may be running
+// on other machines when it's synced by Google Drive or Dropbox. Fails with a *LockedError if another instance holds it,
+// unless mode is ReadOnly.
+func NewWithLock(log *logrus.Logger, directory string, itemsPerPage int, fetcher Fetcher, mode LockMode) (*Aggregator, error) {
+	return NewWithRules(log, directory, itemsPerPage, fetcher, mode, nil)
+}
+
+// NewWithRules is NewWithLock with per-domain rules for cleaning item URLs, see SetURLRules(). They are in place
+// before the html files are loaded, so the seen index saved under them is used instead of being rebuilt every start.
+func NewWithRules(log *logrus.Logger, directory string, itemsPerPage int, fetcher Fetcher, mode LockMode, rules map[string]URLRule) (agg *Aggregator, err error) {
 	if directory == "" {
 		directory = "news"
 	}
-	agg := &Aggregator{
-		Items:        make([]Item, 0),
-		Feeds:        make(map[string]string),
-		KnownItems:   make(map[string]bool),
-		Directory:    filepath.Clean(directory),
-		URLFetcher:   URLFetcher,
-		ItemsPerPage: itemsPerPage,
-		pages:        1,
-		log:          log,
+	agg = &Aggregator{
+		Items:           make([]Item, 0),
+		Feeds:           make(map[string]string),
+		FeedInfos:       make(map[string]*FeedInfo),
+		known:           newSeenIndex(),
+		Directory:       filepath.Clean(directory),
+		Fetcher:         fetcher,
+		Clock:           time.Now,
+		Shuffle:         true,
+		ItemsPerPage:    itemsPerPage,
+		Workers:         4,
+		FailureBackoff:  10 * time.Minute,
+		MaxFailures:     20,
+		DefaultInterval: 10 * time.Minute,
+		MinInterval:     10 * time.Minute,
+		MaxInterval:     24 * time.Hour,
+		ClusterWindow:   48 * time.Hour,
+		ReadOnly:        mode == ReadOnly,
+		pages:           1,
+		log:             log,
+	}
+	if rules != nil {
+		agg.urlRules = withDefaultURLRules(rules)
 	}
 
 	if !fileExists(agg.Directory) {
@@ -75,8 +165,26 @@ func NewWithCustom(log *logrus.Logger, directory string, itemsPerPage int, URLFe
 			return nil, fmt.Errorf("directory %s does not exist", agg.Directory)
 		}
 	}
+	if !agg.ReadOnly {
+		if agg.lock, err = acquireDirLock(log, agg.Directory, mode); err != nil {
+			return nil, err
+		}
+		// Returning nil on error would leave agg.Close() nothing to release, so the lock is given back here
+		lock := agg.lock
+		defer func() {
+			if err != nil {
+				lock.release()
+			}
+		}()
+	}
 	indexFile := filepath.Clean(agg.Directory + "/index.html")
+	if !fileExists(indexFile) && agg.ReadOnly {
+		return nil, fmt.Errorf("could not find %s", indexFile)
+	}
 	if !fileExists(indexFile) {
+		if _, _, _, err := agg.recoverIndex(indexFile, fmt.Errorf("%s is missing", indexFile)); err == nil {
+			return agg, nil
+		}
 		if err := createSampleIndex(indexFile); err != nil {
 			return nil, fmt.Errorf("could not create sample index.html file: %s", err)
 		}
@@ -87,15 +195,18 @@ func NewWithCustom(log *logrus.Logger, directory string, itemsPerPage int, URLFe
 }
 
 // parseXML returns items ordered from oldest to newest. So we can always just append as long as template reads in inverted order.
-func (agg *Aggregator) parseXML(XML []byte) (items []Item, err error) {
-	cleanXML := cleanXML(XML)
+// It also returns the feed's refresh hints, if any.
+func (agg *Aggregator) parseXML(XML []byte) (items []Item, hints RefreshHints, err error) {
+	cleanXML := cleanXML(decodeToUTF8(XML, ""))
 	items = make([]Item, 0)
 	parser := gofeed.NewParser()
 	parser.RSSTranslator = NewCustomRSSTranslator()
+	parser.AtomTranslator = NewCustomAtomTranslator()
+	parser.JSONTranslator = NewCustomJSONTranslator()
 	feed, err := parser.ParseString(string(cleanXML))
 	//feed, err := rss.Parse(cleanXML)
 	if err != nil {
-		return items, fmt.Errorf("could not parse XML: %s", err)
+		return items, hints, fmt.Errorf("could not parse XML: %s", err)
 	}
 	// if err != nil && strings.Contains(err.Error(), "invalid character entity") {
 	//      cleanXML = []byte(unescapeXML(string(cleanXML)))
@@ -103,8 +214,10 @@ func (agg *Aggregator) parseXML(XML []byte) (items []Item, err error) {
 	// }
 	for _, item := range feed.Items {
 		itemURL := strings.TrimSpace(item.Link)
-		if item.Custom["Comments"] != "" {
-			itemURL = strings.TrimSpace(item.Custom["Comments"])
+		discussionURL := strings.TrimSpace(item.Custom["Comments"])
+		if itemURL == "" || itemURL == discussionURL {
+			itemURL = discussionURL
+			discussionURL = ""
 		}
 		if itemURL == "" {
 			agg.log.Debugf("skipping item from feed %s due to lack of URL", feed.Link)
@@ -118,102 +231,212 @@ func (agg *Aggregator) parseXML(XML []byte) (items []Item, err error) {
 			}
 			agg.log.Debugf("using %s to fill in feed %s item empty description", itemTitle, feed.Link)
 		}
-		items = append([]Item{{
-			Title: itemTitle,
-			URL:   itemURL,
-		}}, items...)
+		newItem := Item{
+			Title:         itemTitle,
+			URL:           itemURL,
+			DiscussionURL: discussionURL,
+			Summary:       summarize(item.Description),
+			GUID:          strings.TrimSpace(item.GUID),
+		}
+		if item.PublishedParsed != nil {
+			newItem.PublishedAt = *item.PublishedParsed
+		}
+		if item.UpdatedParsed != nil {
+			newItem.UpdatedAt = *item.UpdatedParsed
+		}
+		if item.Author != nil {
+			newItem.Author = strings.TrimSpace(item.Author.Name)
+		}
+		items = append([]Item{newItem}, items...)
 	}
-	return items, nil
+	distrustRepeatedGUIDs(items)
+	return items, refreshHintsFromFeed(feed), nil
 }
 
-// MakeURLFetcher is the default HTTP client used to fetch feed XML.
+// MakeURLFetcher is the default Fetcher, used to fetch feeds over HTTP.
 // The other one is fakeURLFetcher() used for testing.
-// There's also a retired makeCachedURLFetcher() which was using during initial phases of development and is kept in misc.go
-func MakeURLFetcher(log *logrus.Logger, minDomainRequestInterval time.Duration, client *http.Client) func(URL string) (content []byte, err error) {
-	antiFlood := makeURLDebouncer(log, minDomainRequestInterval)
-	return func(URL string) (content []byte, err error) {
-		req, err := http.NewRequest("GET", antiFlood(URL), nil)
-		if err != nil {
-			return nil, fmt.Errorf("could not create GET request to URL %s : %s", URL, err)
-		}
-		req.Header.Set("User-Agent", uarand.GetRandom())
-		req.Header.Set("Accept", "application/xml")
-		req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+// MakeSourceFetcher() wraps it to also read feeds from local files and commands.
+// It is safe for concurrent use. Requests to the same host are serialized and spaced by minDomainRequestInterval.
+// Validators in the request make it a conditional GET. Permanent redirects are reported through Response.MovedPermanently.
+func MakeURLFetcher(log *logrus.Logger, minDomainRequestInterval time.Duration, client *http.Client) Fetcher {
+	return Chain(&httpFetcher{client: client}, RateLimit(log, minDomainRequestInterval), Logging(log))
+}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			return []byte(""), fmt.Errorf("could not open URL %s : %s", URL, err)
-		}
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return []byte(""), fmt.Errorf("could not read body of URL %s : %s", URL, err)
-		}
-		return body, nil
+// StatusError is returned when a feed answers with a non-2xx HTTP status
+type StatusError struct {
+	URL        string
+	StatusCode int
+	// RetryAt is set from the Retry-After header of 429 and 503 responses
+	RetryAt time.Time
+}
+
+// newStatusError describes resp, reading its Retry-After header if it is a 429 or 503
+func newStatusError(URL string, resp *Response) *StatusError {
+	statusErr := &StatusError{URL: URL, StatusCode: resp.StatusCode}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		statusErr.RetryAt = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
 	}
+	return statusErr
 }
 
-func savePageToFile(fileName string, items []Item, feeds map[string]string, nextPage int) error {
-	f, err := os.Create(fileName)
-	defer f.Close()
-	if err != nil {
+func (err *StatusError) Error() string {
+	msg := fmt.Sprintf("%s returned %d %s", err.URL, err.StatusCode, http.StatusText(err.StatusCode))
+	if !err.RetryAt.IsZero() {
+		msg += " and asked to retry after " + err.RetryAt.Format(time.RFC3339)
+	}
+	return msg
+}
+
+// parseRetryAfter reads a Retry-After header which holds either a number of seconds or an HTTP date.
+// Returns zero time if the header is missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Time {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return time.Time{}
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return date
+	}
+	return time.Time{}
+}
+
+func savePageToFile(fileName string, items []Item, feeds map[string]string, feedInfos map[string]*FeedInfo, nextPage int) error {
+	return savePage(fileName, pageBackups, items, feeds, feedInfos, nextPage)
+}
+
+// saveIndex saves index.html. Only the first save of an update rotates its backups, so they keep the state
+// before each of the last updates rather than before each feed of the latest one.
+// Fails with ErrLeaseLost once another instance took the directory over.
+func (agg *Aggregator) saveIndex(indexFile string, items []Item, feeds map[string]string, feedInfos map[string]*FeedInfo) error {
+	if err := agg.checkLease(); err != nil {
 		return err
 	}
-	return Tpl.Execute(f, map[string]interface{}{
-		"Items":    items,
-		"Feeds":    feeds,
-		"NextPage": nextPage,
+	backups := pageBackups
+	if agg.indexBackedUp {
+		backups = 0
+	}
+	if err := savePage(indexFile, backups, items, feeds, feedInfos, agg.pages); err != nil {
+		return err
+	}
+	agg.indexBackedUp = true
+	return nil
+}
+
+func savePage(fileName string, backups int, items []Item, feeds map[string]string, feedInfos map[string]*FeedInfo, nextPage int) error {
+	return writeFileAtomically(fileName, backups, func(w io.Writer) error {
+		return Tpl.Execute(w, map[string]interface{}{
+			"Items":     items,
+			"Feeds":     feeds,
+			"FeedInfos": feedInfos,
+			"NextPage":  nextPage,
+		})
 	})
 }
 
-func loadFromFile(filePath string) (items []Item, feeds map[string]string, err error) {
+func loadFromFile(filePath string) (items []Item, feeds map[string]string, feedInfos map[string]*FeedInfo, err error) {
 	f, err := os.Open(filePath)
 	if err != nil {
-		return items, feeds, fmt.Errorf("could not open file %s : %s", filePath, err)
+		return items, feeds, feedInfos, fmt.Errorf("could not open file %s : %s", filePath, err)
 	}
 	defer f.Close()
 	return loadFromReader(f)
 }
 
-func loadFromReader(r io.Reader) (items []Item, feeds map[string]string, err error) {
+func loadFromReader(r io.Reader) (items []Item, feeds map[string]string, feedInfos map[string]*FeedInfo, err error) {
 	items = make([]Item, 0)
 	feeds = make(map[string]string)
+	feedInfos = make(map[string]*FeedInfo)
 	doc, err := goquery.NewDocumentFromReader(r)
 	if err != nil {
-		return items, feeds, fmt.Errorf("could not parse HTML: %s", err)
+		return items, feeds, feedInfos, fmt.Errorf("could not parse HTML: %s", err)
 	}
-	doc.Find(".item .tag").Remove()
 	doc.Find(".item").Each(func(i int, s *goquery.Selection) {
+		published := s.Find("time.published").AttrOr("datetime", "")
+		s.Find(".tag, time, .refreshed").Remove()
 		newItem := Item{
-			Title: s.Text(),
-			URL:   s.AttrOr("href", ""),
+			Title:         s.Text(),
+			URL:           s.AttrOr("href", ""),
+			DiscussionURL: s.AttrOr("data-discussion", ""),
+			PublishedAt:   parseTimeOr(published, time.Time{}),
+			UpdatedAt:     parseTimeOr(s.AttrOr("data-updated", ""), time.Time{}),
+			Author:        s.AttrOr("data-author", ""),
+			GUID:          s.AttrOr("data-guid", ""),
+			Summary:       s.AttrOr("title", ""),
+			Feed:          s.AttrOr("data-feed", ""),
+			FirstSeen:     parseTimeOr(s.AttrOr("data-first-seen", ""), time.Time{}),
+			RefreshedAt:   parseTimeOr(s.AttrOr("data-refreshed", ""), time.Time{}),
+		}
+		// Items whose main link is the discussion keep their article in data-article
+		if article, found := s.Attr("data-article"); found {
+			newItem.DiscussionURL = newItem.URL
+			newItem.URL = article
+			newItem.DiscussionFirst = true
 		}
 		newItem.SetTag()
+		// Related items are rendered right before their story, PrevUntil lists them from nearest to farthest
+		related := s.PrevUntil(":not(.related, .comments)").Filter(".related")
+		for j := related.Length() - 1; j >= 0; j-- {
+			r := related.Eq(j)
+			newItem.Related = append(newItem.Related, Related{
+				Title: r.AttrOr("title", ""),
+				URL:   r.AttrOr("href", ""),
+				Tag:   strings.TrimSpace(r.Text()),
+				Feed:  r.AttrOr("data-feed", ""),
+			})
+		}
 		items = append(items, newItem)
 	})
 	doc.Find(".feed").Each(func(i int, s *goquery.Selection) {
-		feeds[s.AttrOr("href", "")] = s.Text()
+		feedURL := normalizeSourceURL(s.AttrOr("href", ""))
+		feeds[feedURL] = s.Text()
+		feedInfos[feedURL] = &FeedInfo{
+			ETag:         s.AttrOr("data-etag", ""),
+			LastModified: s.AttrOr("data-last-modified", ""),
+			Failures:     atoiOr(s.AttrOr("data-failures", ""), 0),
+			LastError:    s.AttrOr("data-last-error", ""),
+			LastSuccess:  parseTimeOr(s.AttrOr("data-last-success", ""), time.Time{}),
+			RetryAt:      parseTimeOr(s.AttrOr("data-retry-at", ""), time.Time{}),
+			Disabled:     s.AttrOr("data-disabled", "") != "",
+			Gone:         s.AttrOr("data-gone", "") != "",
+			Hints: RefreshHints{
+				TTL:       parseDurationOr(s.AttrOr("data-ttl", ""), 0),
+				SkipHours: parseSkipHours(s.AttrOr("data-skip-hours", "")),
+				SkipDays:  parseSkipDays(s.AttrOr("data-skip-days", "")),
+			},
+			Interval:         parseDurationOr(s.AttrOr("data-interval", ""), 0),
+			PreferDiscussion: s.AttrOr("data-link", "") == "discussion",
+			Scrape:           scrapeSelectorsFromAnchor(s),
+			NextFetch:        parseTimeOr(s.AttrOr("data-next-fetch", ""), time.Time{}),
+		}
 	})
-	return items, feeds, nil
+	return items, feeds, feedInfos, nil
 }
 
 // fixRelativeURL prepends domain name to relative URLs when necessary
 func (item *Item) fixRelativeURL(feedURL string) {
-	if strings.HasPrefix(item.URL, "/") {
-		u, err := url.Parse(feedURL)
-		if err == nil {
-			item.URL = u.Scheme + "://" + u.Host + item.URL
+	for _, itemURL := range []*string{&item.URL, &item.DiscussionURL} {
+		if strings.HasPrefix(*itemURL, "/") {
+			u, err := url.Parse(feedURL)
+			if err == nil {
+				*itemURL = u.Scheme + "://" + u.Host + *itemURL
+			}
 		}
 	}
 }
 
-// SetTag fills .Tag based on the URL. Examples:
+// SetTag fills .Tag based on the DiscussionURL, or the URL if there's none. Examples:
 // /r/programming for https://www.reddit.com/r/programming/comments/9p07bh/convert_string_to_int_in_java/
 // slashdot for https://science.slashdot.org/story/18/10/17/1552218/the-results-of-your-genetic-test-are-reassuring-but-that-can-change
 // Hacker News for https://news.ycombinator.com/item?id=18240182
 // domain.com for https://www.domain.com/item123
 func (item *Item) SetTag() {
 	URL := strings.ToLower(strings.TrimSpace(item.URL))
+	if item.DiscussionURL != "" {
+		URL = strings.ToLower(strings.TrimSpace(item.DiscussionURL))
+	}
 	item.Tag = ""
 	if strings.Contains(URL, "reddit.com/r/") {
 		parts := strings.Split(URL, "reddit.com/r/")
@@ -228,29 +451,48 @@ func (item *Item) SetTag() {
 	}
 }
 
+// loadFeedsAndItemsFromHTMLFiles reads feeds and items from index.html and the identities of older items from the seen
+// index. pageN.html files are only read when the seen index is missing or out of date, to rebuild it.
 func (agg *Aggregator) loadFeedsAndItemsFromHTMLFiles() error {
-	for i := 1; ; i++ {
-		filePath := filepath.Clean(agg.Directory + "/index.html")
+	pageFile := func(i int) string {
 		if i > 1 {
-			filePath = filepath.Clean(fmt.Sprintf(agg.Directory+"/page%d.html", i))
-		}
-		if !fileExists(filePath) {
-			if i == 0 {
-				return fmt.Errorf("could not find index.html. You need to create %s and make sure it has at least one feed URL in it. See example index.html in github", filePath)
-			}
-			break
+			return filepath.Clean(fmt.Sprintf(agg.Directory+"/page%d.html", i))
 		}
-		agg.pages = i
+		return filepath.Clean(agg.Directory + "/index.html")
+	}
+	pages := 0
+	for fileExists(pageFile(pages + 1)) {
+		pages++
+	}
+	if pages > 0 {
+		agg.pages = pages
+	}
+	agg.known = agg.loadSeenIndex(pages)
+	rebuild := agg.known == nil
+	if rebuild {
+		agg.known = newSeenIndex()
+	}
+	for i := 1; i <= pages && (i == 1 || rebuild); i++ {
+		filePath := pageFile(i)
 		agg.log.Debugf("reading items from %s", filePath)
-		items, feeds, err := loadFromFile(filePath)
+		items, feeds, feedInfos, err := loadFromFile(filePath)
 		if err != nil {
 			return fmt.Errorf("could not load known URLs from file %s : %s", filePath, err)
 		}
 		if i == 1 {
 			agg.Feeds = feeds
+			agg.FeedInfos = feedInfos
 		}
 		for _, item := range items {
-			agg.KnownItems[item.URL] = true
+			agg.markKnown(item)
+			for _, related := range item.Related {
+				agg.markKnown(Item{URL: related.URL, Feed: related.Feed})
+			}
+		}
+	}
+	if rebuild && pages > 0 {
+		if err := agg.saveSeenIndex(); err != nil {
+			agg.log.Error(err)
 		}
 	}
 	return nil
@@ -264,10 +506,13 @@ func getSampleFeeds() map[string]string {
 }
 
 func createSampleIndex(file string) error {
-	return savePageToFile(file, []Item{}, getSampleFeeds(), 0)
+	return savePageToFile(file, []Item{}, getSampleFeeds(), nil, 0)
 }
 
 func (agg *Aggregator) ImportOPMLFile(filePath string) (importedFeeds int, err error) {
+	if agg.ReadOnly {
+		return 0, fmt.Errorf("can't import feeds to %s in read-only mode", agg.Directory)
+	}
 	doc, err := opml.NewOPMLFromFile(filePath)
 	if err != nil {
 		return 0, err
@@ -282,11 +527,11 @@ func (agg *Aggregator) ImportOPMLFile(filePath string) (importedFeeds int, err e
 	}
 	// Save feeds to index.html
 	indexFile := filepath.Clean(agg.Directory + "/index.html")
-	indexItems, _, err := loadFromFile(indexFile)
+	indexItems, _, _, err := loadFromFile(indexFile)
 	if err != nil {
 		return 0, fmt.Errorf("could not save imported feeds to %s: %s", indexFile, err)
 	}
-	if err := savePageToFile(indexFile, indexItems, agg.Feeds, agg.pages); err != nil {
+	if err := savePageToFile(indexFile, indexItems, agg.Feeds, agg.FeedInfos, agg.pages); err != nil {
 		return 0, fmt.Errorf("could not save imported feeds to %s: %s", indexFile, err)
 	}
 
@@ -307,7 +552,8 @@ func (agg *Aggregator) ImportOPMLFile(filePath string) (importedFeeds int, err e
 func collectFeedsFromOPMLOutline(feeds map[string]string, outlines []opml.Outline) {
 	for _, outline := range outlines {
 
-		if outline.XMLURL != "" {
+		// Local sources run commands and read files, they are only added to index.html by hand
+		if outline.XMLURL != "" && !isLocalSource(outline.XMLURL) {
 			feeds[outline.XMLURL] = strings.TrimSpace(outline.Text)
 			// If feed title is empty, use URL instead
 			if feeds[outline.XMLURL] == "" {
@@ -320,40 +566,113 @@ func collectFeedsFromOPMLOutline(feeds map[string]string, outlines []opml.Outlin
 	}
 }
 
-// Update reads feed URLs from index.html, fetches RSS/Atom feed from each URL found and save everything back to index.html.
+// Update reads feed URLs from index.html, fetches RSS/Atom feed from each URL that is due and save everything back to index.html.
 // Also generates new pageX.html files when index.html is too large.
+// Feeds are fetched by agg.Workers goroutines but their items are merged in a fixed order, one feed at a time,
+// so the result doesn't depend on which request happens to finish first.
 func (agg *Aggregator) Update() (err error) {
+	if err := agg.checkLease(); err != nil {
+		return err
+	}
+	start := agg.now()
 	indexFile := agg.Directory + "/index.html"
-	indexItems, feeds, err := loadFromFile(indexFile)
-	// If we can't read feed sources from index.html, might as well stop now
-	if err != nil {
+	agg.indexBackedUp = false
+	indexItems, feeds, feedInfos, err := loadFromFile(indexFile)
+	if err == nil && len(feeds) == 0 {
+		err = fmt.Errorf("zero feed sources found in file %s", indexFile)
+	}
+	// Without feed sources there's nothing to do, so a broken index.html is restored from backups first
+	if err != nil && agg.ReadOnly {
 		return err
-	} else if len(feeds) == 0 {
-		return fmt.Errorf("zero feed sources found in file %s", indexFile)
+	}
+	if err != nil {
+		if indexItems, feeds, feedInfos, err = agg.recoverIndex(indexFile, err); err != nil {
+			return err
+		}
+	}
+	if !agg.ReadOnly {
+		if indexItems, err = agg.mergeConflictCopies(indexFile, indexItems, feeds, feedInfos); err != nil {
+			agg.log.Error(err)
+		}
 	}
 	agg.Items = indexItems
 	agg.Feeds = feeds
-	// Access feeds in random order
-	suffledURLs := shuffleMapKeys(agg.Feeds)
-	for _, feedURL := range suffledURLs {
-		agg.log.Debugf("reading items from %s", feedURL)
-		contents, err := agg.URLFetcher(feedURL)
-		if err != nil {
-			agg.log.Errorf("%s : %s", feedURL, err)
-			continue
+	agg.FeedInfos = feedInfos
+	// Access feeds in random order, but avoid lining up several feeds from the same host
+	feedURLs := sortedMapKeys(agg.Feeds)
+	if agg.Shuffle {
+		feedURLs = shuffleMapKeys(agg.Feeds)
+	}
+	feedURLs = agg.dueFeeds(interleaveByHost(feedURLs), start)
+	agg.log.Infof("Fetching news from %d of %d feed sources...", len(feedURLs), len(agg.Feeds))
+	results := agg.fetchAll(feedURLs)
+	// Feeds that moved permanently during this update, old URL -> new URL
+	moved := make(map[string]string)
+	// How many items at the top of agg.Items were found during this update
+	fresh := 0
+	for i, feedURL := range feedURLs {
+		result := <-results[i]
+		info := agg.FeedInfos[feedURL]
+		*info = result.info
+		var delayedErr *hostDelayedError
+		if result.err == ErrNotModified {
+			agg.log.Debugf("%s : %s", feedURL, result.err)
+			info.recordSuccess(agg.now())
+			// Scheduling from the start of this update rather than from now keeps feeds due on the next one
+			info.scheduleNextFetch(start, agg.DefaultInterval, agg.MinInterval, agg.MaxInterval)
+		} else if errors.As(result.err, &delayedErr) {
+			// Another feed of the same host asked us to come back later, this one was not even asked
+			agg.log.Debugf("%s : %s", feedURL, result.err)
+			if delayedErr.RetryAt.After(info.RetryAt) {
+				info.RetryAt = delayedErr.RetryAt
+			}
+		} else if result.err != nil {
+			agg.log.Errorf("%s : %s", feedURL, result.err)
+			if info.recordFailure(result.err, agg.now(), agg.FailureBackoff, agg.MaxFailures) {
+				agg.log.Warnf("%s : disabled after %d consecutive failures. Remove its data-disabled attribute from index.html to enable it again", feedURL, info.Failures)
+			}
+			var statusErr *StatusError
+			if errors.As(result.err, &statusErr) {
+				if statusErr.RetryAt.After(info.RetryAt) {
+					info.RetryAt = statusErr.RetryAt
+				}
+				if statusErr.StatusCode == http.StatusGone {
+					info.Gone = true
+					info.Disabled = true
+					agg.log.Warnf("%s : feed is gone for good and has been disabled. Consider removing it from index.html", feedURL)
+				}
+			}
+		} else {
+			info.recordSuccess(agg.now())
+			info.Hints = result.hints
+			info.scheduleNextFetch(start, agg.DefaultInterval, agg.MinInterval, agg.MaxInterval)
+			if info.MovedTo != "" {
+				agg.log.Infof("%s : feed now lives at %s, updating index.html", feedURL, info.MovedTo)
+				moved[feedURL] = info.MovedTo
+				renameFeed(agg.Feeds, feedURL, info.MovedTo)
+				delete(agg.FeedInfos, feedURL)
+				agg.FeedInfos[info.MovedTo] = info
+				// Its news belong to the new URL too, or they'd point to a feed that's gone and GUIDs would be scoped to it
+				feedURL = info.MovedTo
+				info.MovedTo = ""
+			}
+			added := agg.addItems(feedURL, result.items)
+			if agg.ReadOnly {
+				for _, item := range agg.Items[:added] {
+					agg.log.Infof("%s : new %q %s", feedURL, item.Title, item.URL)
+				}
+			}
+			fresh += added
+			if agg.Chronological {
+				sortByDate(agg.Items[:fresh])
+			}
 		}
-		items, err := agg.parseXML(contents)
-		if err != nil {
-			agg.log.Errorf("%s: %s", feedURL, err)
+		if agg.ReadOnly {
 			continue
 		}
-		for i := len(items) - 1; i >= 0; i-- {
-			items[i].fixRelativeURL(feedURL)
-			if agg.KnownItems[items[i].URL] == false {
-				items[i].SetTag()
-				agg.KnownItems[items[i].URL] = true
-				agg.Items = append([]Item{items[i]}, agg.Items...)
-			}
+		// Updates can take many minutes, long enough for another instance to take the directory over
+		if err := agg.checkLease(); err != nil {
+			return err
 		}
 		// Every time index.html grows too large, we shave half of its oldest items into a new page
 		for len(agg.Items) >= agg.ItemsPerPage*2 {
@@ -361,22 +680,214 @@ func (agg *Aggregator) Update() (err error) {
 			agg.pages++
 			agg.log.Debugf("saving items to page%d.html", agg.pages)
 			pageFile := fmt.Sprintf(agg.Directory+"/page%d.html", agg.pages)
-			if err := savePageToFile(pageFile, pageItems, agg.Feeds, agg.pages-1); err != nil {
+			if err := savePageToFile(pageFile, pageItems, agg.Feeds, agg.FeedInfos, agg.pages-1); err != nil {
 				agg.log.Errorf("error saving page %s : %s", pageFile, err)
 				continue
 			}
 			agg.Items = agg.Items[:agg.ItemsPerPage]
 		}
+		if fresh > len(agg.Items) {
+			fresh = len(agg.Items)
+		}
 		// User might have updated feeds in index.html, so we must read it again to prevent overwriting
-		_, feedsToSave, err := loadFromFile(indexFile)
+		_, feedsToSave, feedInfosToSave, err := loadFromFile(indexFile)
+		if err == nil && len(feedsToSave) == 0 {
+			err = fmt.Errorf("zero feed sources found")
+		}
 		if err != nil {
 			agg.log.Errorf("error reading feeds before writing to %s: %s", indexFile, err)
 			feedsToSave = agg.Feeds
+			feedInfosToSave = agg.FeedInfos
+		}
+		for oldURL, newURL := range moved {
+			renameFeed(feedsToSave, oldURL, newURL)
+		}
+		// Feeds added by the user in the meantime keep whatever they have, the rest take our fresher bookkeeping
+		// except for settings which only users change
+		for feedURL, info := range agg.FeedInfos {
+			if fileInfo, found := feedInfosToSave[feedURL]; found {
+				info.Interval = fileInfo.Interval
+				info.PreferDiscussion = fileInfo.PreferDiscussion
+				info.Scrape = fileInfo.Scrape
+			}
+			feedInfosToSave[feedURL] = info
 		}
-		if err := savePageToFile(indexFile, agg.Items, feedsToSave, agg.pages); err != nil {
+		if err := agg.saveIndex(indexFile, agg.Items, feedsToSave, feedInfosToSave); errors.Is(err, ErrLeaseLost) {
+			return err
+		} else if err != nil {
 			agg.log.Errorf("error saving page %s : %s", indexFile, err)
 			continue
 		}
 	}
+	if err := agg.saveSeenIndex(); errors.Is(err, ErrLeaseLost) {
+		return err
+	} else if err != nil {
+		agg.log.Error(err)
+	}
 	return nil
 }
+
+// renameFeed replaces oldURL with newURL in feeds keeping its title. Does nothing if oldURL is not there.
+func renameFeed(feeds map[string]string, oldURL, newURL string) {
+	title, found := feeds[oldURL]
+	if !found {
+		return
+	}
+	delete(feeds, oldURL)
+	if _, found := feeds[newURL]; !found {
+		feeds[newURL] = title
+	}
+}
+
+// addItems prepends items not seen before to agg.Items. items are ordered from oldest to newest like parseXML returns them.
+// Returns how many items were added.
+// Items are known by their URL and also by their DiscussionURL, which used to be their only URL for feeds like Hacker News.
+// Items from other feeds about a story which is already in agg.Items are attached to it, see storyIndex.storyOf().
+func (agg *Aggregator) addItems(feedURL string, items []Item) (added int) {
+	now := agg.now()
+	info := agg.FeedInfos[feedURL]
+	stories := agg.newStoryIndex()
+	for i := len(items) - 1; i >= 0; i-- {
+		items[i].fixRelativeURL(feedURL)
+		items[i].URL = cleanURL(items[i].URL, agg.rules())
+		if items[i].DiscussionURL != "" {
+			items[i].DiscussionURL = cleanURL(items[i].DiscussionURL, agg.rules())
+		}
+		items[i].Feed = feedURL
+		known := agg.isKnown(items[i])
+		if position := stories.entryOf(items[i]); known && position >= 0 {
+			if entry := stories.item(position); agg.RefreshKnownItems && entry.refresh(items[i], now, agg.MarkRefreshed) {
+				agg.log.Debugf("%s : refreshed %q", feedURL, entry.Title)
+				stories.add(position)
+			}
+			continue
+		}
+		// Other feeds' items about a story already in index.html are attached to it rather than added
+		if position := stories.storyOf(items[i], now); position >= 0 {
+			if story := stories.item(position); story.relate(items[i]) {
+				agg.log.Debugf("%s : %q is the same story as %q", feedURL, items[i].Title, story.Title)
+				stories.add(position)
+			}
+			agg.markKnown(items[i])
+			continue
+		}
+		if !known {
+			items[i].SetTag()
+			items[i].FirstSeen = now
+			items[i].DiscussionFirst = items[i].DiscussionURL != "" && info != nil && info.PreferDiscussion
+			agg.markKnown(items[i])
+			agg.Items = append([]Item{items[i]}, agg.Items...)
+			stories.add(len(agg.Items) - 1)
+			added++
+		}
+	}
+	return added
+}
+
+// now asks agg.Clock for the time, falling back to time.Now for Aggregators not created through NewWithCustom
+func (agg *Aggregator) now() time.Time {
+	if agg.Clock == nil {
+		return time.Now()
+	}
+	return agg.Clock()
+}
+
+// dueFeeds filters out feeds that are disabled, backing off after failures or not due according to their schedule
+func (agg *Aggregator) dueFeeds(feedURLs []string, now time.Time) []string {
+	due := make([]string, 0, len(feedURLs))
+	for _, feedURL := range feedURLs {
+		info := agg.FeedInfos[feedURL]
+		if info != nil && info.Disabled {
+			agg.log.Debugf("skipping disabled feed %s", feedURL)
+			continue
+		}
+		if info != nil && now.Before(info.RetryAt) {
+			agg.log.Debugf("skipping feed %s until %s after %d failures", feedURL, info.RetryAt.Format(time.RFC3339), info.Failures)
+			continue
+		}
+		if info != nil && now.Before(info.NextFetch) {
+			agg.log.Debugf("skipping feed %s until it is due at %s", feedURL, info.NextFetch.Format(time.RFC3339))
+			continue
+		}
+		due = append(due, feedURL)
+	}
+	return due
+}
+
+// fetchResult holds the outcome of fetching and parsing a single feed
+type fetchResult struct {
+	items []Item
+	hints RefreshHints
+	info  FeedInfo // updated copy of the feed's bookkeeping
+	err   error
+}
+
+// fetchAll fetches and parses feedURLs using agg.Workers goroutines.
+// The returned channels match feedURLs by index and each receives exactly one result.
+// Workers only get copies of FeedInfos so the caller can keep saving pages while fetches are in flight.
+func (agg *Aggregator) fetchAll(feedURLs []string) []chan fetchResult {
+	results := make([]chan fetchResult, len(feedURLs))
+	infos := make([]FeedInfo, len(feedURLs))
+	for i, feedURL := range feedURLs {
+		results[i] = make(chan fetchResult, 1)
+		if agg.FeedInfos[feedURL] == nil {
+			agg.FeedInfos[feedURL] = &FeedInfo{}
+		}
+		infos[i] = *agg.FeedInfos[feedURL]
+	}
+	jobs := make(chan int)
+	workers := agg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				results[i] <- agg.fetchFeed(feedURLs[i], infos[i])
+			}
+		}()
+	}
+	go func() {
+		for i := range feedURLs {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	return results
+}
+
+func (agg *Aggregator) fetchFeed(feedURL string, info FeedInfo) (result fetchResult) {
+	agg.log.Debugf("reading items from %s", feedURL)
+	// Validators of a response that couldn't be used would have the next fetch answered with 304, losing its items for good
+	etag, lastModified := info.ETag, info.LastModified
+	defer func() {
+		if result.err != nil {
+			result.info.ETag, result.info.LastModified = etag, lastModified
+		}
+	}()
+	body, contentType, err := agg.fetch(feedURL, &info)
+	if err != nil {
+		return fetchResult{info: info, err: err}
+	}
+	if info.Scrape != nil {
+		items, err := agg.scrapeHTML(decodeHTMLToUTF8(body, contentType), feedURL, info.Scrape)
+		return fetchResult{items: items, info: info, err: err}
+	}
+	contents := decodeToUTF8(body, contentType)
+	items, hints, err := agg.parseXML(contents)
+	// Only feeds that never worked are looked for in web pages. A working feed answering with a web page once,
+	// such as an interstitial or an error page, is just failing and must not be replaced for good.
+	if err != nil && looksLikeHTML(contents) && !info.LastSuccess.IsZero() {
+		return fetchResult{info: info, err: fmt.Errorf("got a web page instead of a feed")}
+	}
+	if err != nil && looksLikeHTML(contents) {
+		if discoveredURL, discovered := agg.discoverFeed(feedURL, decodeHTMLToUTF8(body, contentType)); discoveredURL != "" {
+			info.ETag = discovered.info.ETag
+			info.LastModified = discovered.info.LastModified
+			info.MovedTo = discoveredURL
+			discovered.info = info
+			return discovered
+		}
+	}
+	return fetchResult{items: items, hints: hints, info: info, err: err}
+}
@@ -1,12 +1,28 @@
 package feed
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
 )
 
 // Tests if new items are read and written in the correct order to the HTML file. This isn't fully automated
@@ -52,23 +68,1387 @@ func Test_OPMLFileImport(t *testing.T) {
 	failIfError(t, agg.Update())
 }
 
+// Tests that feeds fetched concurrently still land in index.html as one contiguous block of items per feed
+func Test_ParallelUpdateKeepsFeedItemsTogether(t *testing.T) {
+	dir := t.TempDir()
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fakeURLFetcher)
+	failIfError(t, err)
+	for i := 0; i < 10; i++ {
+		agg.Feeds[fmt.Sprintf("https://host%d.example.com/rss", i%3)+fmt.Sprintf("?feed=%d", i)] = fmt.Sprintf("Feed %d", i)
+	}
+	failIfError(t, savePageToFile(dir+"/index.html", agg.Items, agg.Feeds, agg.FeedInfos, agg.pages))
+	agg.Workers = 8
+	// Fake feeds share item titles, which would otherwise make them one story
+	agg.ClusterWindow = 0
+	failIfError(t, agg.Update())
+	seen := make(map[string]bool)
+	previousFeed := ""
+	for _, item := range agg.Items {
+		feedURL := strings.Split(item.URL, "?item=")[0]
+		if feedURL != previousFeed && seen[feedURL] {
+			t.Errorf("items from %s are not contiguous in index.html", feedURL)
+		}
+		seen[feedURL] = true
+		previousFeed = feedURL
+	}
+	if len(agg.Items) != 4*len(agg.Feeds) {
+		t.Errorf("Expected %d items but found %d", 4*len(agg.Feeds), len(agg.Items))
+	}
+}
+
+// Tests that requests to the same host never overlap while requests to other hosts do not wait
+func Test_HostLimiterSerializesSameHost(t *testing.T) {
+	limiter := newHostLimiter(logrus.New(), 20*time.Millisecond)
+	var inFlight, maxInFlight int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.acquire("https://same.example.com/rss")
+			failIfError(t, err)
+			if n := atomic.AddInt64(&inFlight, 1); n > atomic.LoadInt64(&maxInFlight) {
+				atomic.StoreInt64(&maxInFlight, n)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt64(&inFlight, -1)
+			release()
+		}()
+	}
+	wg.Wait()
+	if maxInFlight != 1 {
+		t.Errorf("Expected at most 1 concurrent request to the same host but found %d", maxInFlight)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected requests to the same host to be spaced by the minimum interval but all 3 took %s", elapsed)
+	}
+	otherStart := time.Now()
+	release, err := limiter.acquire("https://other.example.com/rss")
+	failIfError(t, err)
+	release()
+	if elapsed := time.Since(otherStart); elapsed > 10*time.Millisecond {
+		t.Errorf("Expected request to a different host to proceed immediately but it took %s", elapsed)
+	}
+}
+
+// Tests that cache validators are persisted in index.html and sent back so unchanged feeds are answered with 304
+func Test_ConditionalGETPersistsValidators(t *testing.T) {
+	var fullResponses, notModifiedResponses int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt64(&notModifiedResponses, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt64(&fullResponses, 1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>t</title><item><title>One</title><link>https://example.com/1</link></item></channel></rss>`)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{server.URL: "Test"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, MakeURLFetcher(logrus.New(), 0, server.Client()))
+	failIfError(t, err)
+	// Make the feed due on every update
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	failIfError(t, agg.Update())
+	// A fresh Aggregator must pick the validators up from index.html
+	agg, err = NewWithCustom(logrus.New(), dir, 1000, MakeURLFetcher(logrus.New(), 0, server.Client()))
+	failIfError(t, err)
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	if info := agg.FeedInfos[server.URL]; info == nil || info.ETag != `"v1"` || info.LastModified != "Wed, 21 Oct 2015 07:28:00 GMT" {
+		t.Errorf("Expected validators to be read back from index.html but found %+v", info)
+	}
+	failIfError(t, agg.Update())
+	if fullResponses != 1 || notModifiedResponses != 1 {
+		t.Errorf("Expected 1 full response and 1 not modified response but found %d and %d", fullResponses, notModifiedResponses)
+	}
+	if len(agg.Items) != 1 {
+		t.Errorf("Expected 1 item in index.html but found %d", len(agg.Items))
+	}
+}
+
+// Tests that validators of a response that can't be parsed aren't kept, so the next fetch gets the whole feed again
+// rather than a 304 for a version whose items were never read
+func Test_ValidatorsOfUnparsableResponseDiscarded(t *testing.T) {
+	var responses int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		feed := `<rss version="2.0"><channel><title>t</title><item><title>One</title><link>https://example.com/1</link></item></channel></rss>`
+		if atomic.AddInt64(&responses, 1) == 1 {
+			feed = feed[:40]
+		}
+		fmt.Fprint(w, feed)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{server.URL: "Test"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, MakeURLFetcher(logrus.New(), 0, server.Client()))
+	failIfError(t, err)
+	defer agg.Close()
+	agg.MinInterval, agg.DefaultInterval, agg.FailureBackoff = 0, 0, 0
+	failIfError(t, agg.Update())
+	if info := agg.FeedInfos[server.URL]; info.ETag != "" || info.Failures != 1 {
+		t.Errorf("Expected the truncated response to count as a failure without keeping its ETag but found %+v", info)
+	}
+	failIfError(t, agg.Update())
+	if len(agg.Items) != 1 || responses != 2 {
+		t.Errorf("Expected the whole feed to be fetched again but found %d items after %d responses", len(agg.Items), responses)
+	}
+}
+
+// Tests that failing feeds back off, get disabled after MaxFailures and that this survives a restart
+func Test_FailingFeedIsDisabled(t *testing.T) {
+	var calls int64
+	failingFetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		atomic.AddInt64(&calls, 1)
+		return nil, fmt.Errorf("connection refused")
+	})
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{"https://dead.example.com/rss": "Dead"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, failingFetcher)
+	failIfError(t, err)
+	agg.FailureBackoff = time.Hour
+	agg.MaxFailures = 3
+	failIfError(t, agg.Update())
+	failIfError(t, agg.Update())
+	if calls != 1 {
+		t.Errorf("Expected failing feed to be skipped while backing off but it was fetched %d times", calls)
+	}
+	if retryIn := time.Until(agg.FeedInfos["https://dead.example.com/rss"].RetryAt); retryIn < 59*time.Minute {
+		t.Errorf("Expected retry to be scheduled about an hour from now but it is in %s", retryIn)
+	}
+
+	// Without backoff the feed is retried on every update until it is disabled
+	calls = 0
+	dir = t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{"https://dead.example.com/rss": "Dead"}, nil, 0))
+	agg, err = NewWithCustom(logrus.New(), dir, 1000, failingFetcher)
+	failIfError(t, err)
+	agg.FailureBackoff = 0
+	agg.MaxFailures = 3
+	for i := 0; i < 5; i++ {
+		failIfError(t, agg.Update())
+	}
+	if calls != 3 {
+		t.Errorf("Expected feed to be fetched 3 times before being disabled but it was fetched %d times", calls)
+	}
+	agg, err = NewWithCustom(logrus.New(), dir, 1000, failingFetcher)
+	failIfError(t, err)
+	info := agg.FeedInfos["https://dead.example.com/rss"]
+	if info == nil || !info.Disabled || info.Failures != 3 || info.LastError != "connection refused" {
+		t.Errorf("Expected disabled feed with 3 failures to be read back from index.html but found %+v", info)
+	}
+	html, err := os.ReadFile(dir + "/index.html")
+	failIfError(t, err)
+	if !strings.Contains(string(html), `class="disabled-feed"`) {
+		t.Error("Expected disabled feed to be listed in index.html")
+	}
+}
+
+// Tests that permanent redirects rename feeds in index.html, 410 disables them and 429 honors Retry-After
+func Test_FetcherHandlesStatusCodes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>t</title><item><title>One</title><link>https://example.com/1</link></item></channel></rss>`)
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<html>Not here</html>")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	// Rate limited feed lives on its own host since a 429 holds back every feed from the same host
+	limitedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limitedServer.Close()
+
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{
+		server.URL + "/old":     "Moved",
+		server.URL + "/gone":    "Gone",
+		server.URL + "/missing": "Missing",
+		limitedServer.URL:       "Limited",
+	}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, MakeURLFetcher(logrus.New(), 0, http.DefaultClient))
+	failIfError(t, err)
+	failIfError(t, agg.Update())
+
+	items, feeds, infos, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if _, found := feeds[server.URL+"/old"]; found || feeds[server.URL+"/new"] != "Moved" {
+		t.Errorf("Expected permanently redirected feed to be renamed in index.html but found %v", feeds)
+	}
+	if len(items) != 1 || items[0].Feed != server.URL+"/new" {
+		t.Errorf("Expected news of the redirected feed to belong to its new URL but found %+v", items)
+	}
+	if info := infos[server.URL+"/gone"]; !info.Gone || !info.Disabled {
+		t.Errorf("Expected feed answering 410 to be flagged as gone and disabled but found %+v", info)
+	}
+	if info := infos[server.URL+"/missing"]; !strings.Contains(info.LastError, "404") {
+		t.Errorf("Expected feed answering 404 to record the status as its last error but found %q", info.LastError)
+	}
+	if retryIn := time.Until(infos[limitedServer.URL].RetryAt); retryIn < 59*time.Minute {
+		t.Errorf("Expected rate limited feed to be retried in about an hour but it is in %s", retryIn)
+	}
+}
+
+// Tests that once a host asks to come back later its other feeds are left alone without counting it as their failure
+func Test_RetryAfterHoldsBackHost(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{
+		server.URL + "/a": "A", server.URL + "/b": "B", server.URL + "/c": "C"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, MakeURLFetcher(logrus.New(), 0, server.Client()))
+	failIfError(t, err)
+	failIfError(t, agg.Update())
+	if requests != 1 {
+		t.Errorf("Expected only 1 request to the rate limited host but found %d", requests)
+	}
+	failures := 0
+	for feedURL, info := range agg.FeedInfos {
+		failures += info.Failures
+		if retryIn := time.Until(info.RetryAt); retryIn < 59*time.Minute {
+			t.Errorf("Expected %s to be retried in about an hour but it is in %s", feedURL, retryIn)
+		}
+	}
+	if failures != 1 {
+		t.Errorf("Expected only the feed answering 429 to record a failure but found %d failures", failures)
+	}
+}
+
+// Tests that RSS <ttl>, <skipHours>, <skipDays> and sy:updatePeriod are honored when scheduling the next fetch
+func Test_RefreshHints(t *testing.T) {
+	agg := &Aggregator{log: logrus.New()}
+	_, hints, err := agg.parseXML([]byte(`<rss version="2.0"><channel><title>t</title><ttl>120</ttl>
+		<skipHours><hour>3</hour><hour>4</hour></skipHours><skipDays><day>Sunday</day></skipDays>
+		<item><title>One</title><link>https://example.com/1</link></item></channel></rss>`))
+	failIfError(t, err)
+	if hints.TTL != 2*time.Hour || fmt.Sprint(hints.SkipHours) != "[3 4]" || fmt.Sprint(hints.SkipDays) != "[Sunday]" {
+		t.Errorf("Expected ttl 2h, skip hours [3 4] and skip days [Sunday] but found %+v", hints)
+	}
+	_, hints, err = agg.parseXML([]byte(`<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/"><channel><title>t</title>
+		<sy:updatePeriod>daily</sy:updatePeriod><sy:updateFrequency>2</sy:updateFrequency>
+		<item><title>One</title><link>https://example.com/1</link></item></channel></rss>`))
+	failIfError(t, err)
+	if hints.TTL != 12*time.Hour {
+		t.Errorf("Expected twice daily syndication period to give a 12h ttl but found %s", hints.TTL)
+	}
+
+	saturdayNight := time.Date(2023, 6, 3, 23, 30, 0, 0, time.UTC)
+	hints = RefreshHints{TTL: time.Hour, SkipDays: []time.Weekday{time.Sunday}}
+	if next := hints.nextFetch(saturdayNight, 10*time.Minute, 0, 24*time.Hour); !next.Equal(time.Date(2023, 6, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected skipped Sunday to push next fetch to Monday midnight but found %s", next)
+	}
+	hints = RefreshHints{TTL: time.Minute}
+	if next := hints.nextFetch(saturdayNight, 10*time.Minute, 10*time.Minute, 24*time.Hour); next.Sub(saturdayNight) != 10*time.Minute {
+		t.Errorf("Expected ttl shorter than the minimum interval to be raised to it but next fetch is in %s", next.Sub(saturdayNight))
+	}
+	hints = RefreshHints{TTL: 30 * 24 * time.Hour}
+	if next := hints.nextFetch(saturdayNight, 10*time.Minute, 10*time.Minute, 24*time.Hour); next.Sub(saturdayNight) != 24*time.Hour {
+		t.Errorf("Expected ttl longer than the maximum interval to be lowered to it but next fetch is in %s", next.Sub(saturdayNight))
+	}
+}
+
+// Tests that a data-interval set by hand in index.html schedules the feed and survives saving index.html
+func Test_FeedIntervalFromIndex(t *testing.T) {
+	dir := t.TempDir()
+	failIfError(t, os.WriteFile(dir+"/index.html", []byte(`<a class="feed" href="https://slow.example.com/rss" data-interval="6h">Slow</a>
+		<a class="feed" href="https://fast.example.com/rss">Fast</a>`), 0644))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fakeURLFetcher)
+	failIfError(t, err)
+	if due := agg.NextDue(); time.Since(due) > time.Second {
+		t.Errorf("Expected feeds never fetched to be due right away but next due is %s", due)
+	}
+	failIfError(t, agg.Update())
+	_, _, infos, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if slow := infos["https://slow.example.com/rss"]; slow.Interval != 6*time.Hour || time.Until(slow.NextFetch) < 5*time.Hour {
+		t.Errorf("Expected feed with data-interval=6h to be due in about 6 hours but found %+v", slow)
+	}
+	if due := time.Until(agg.NextDue()); due < 9*time.Minute || due > 10*time.Minute {
+		t.Errorf("Expected next due feed to be the one on the default 10 minutes interval but it is due in %s", due)
+	}
+}
+
+// Tests that web page URLs are replaced in index.html by the feed they advertise or by a feed found at a common path
+func Test_FeedAutodiscovery(t *testing.T) {
+	rss := `<rss version="2.0"><channel><title>t</title><item><title>One</title><link>https://example.com/1</link></item></channel></rss>`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/advertised/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<!DOCTYPE html><html><head><link rel="alternate" type="application/rss+xml" href="/advertised/rss.xml"></head><body>Blog</body></html>`)
+	})
+	mux.HandleFunc("/advertised/rss.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, rss)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	// Site without <link rel="alternate"> but a feed at /feed
+	unadvertisedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/feed" {
+			fmt.Fprint(w, rss)
+			return
+		}
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `<html><body>Homepage</body></html>`)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer unadvertisedServer.Close()
+
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{
+		server.URL + "/advertised/":  "Advertised",
+		unadvertisedServer.URL + "/": "Unadvertised",
+	}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, MakeURLFetcher(logrus.New(), 0, http.DefaultClient))
+	failIfError(t, err)
+	failIfError(t, agg.Update())
+	_, feeds, _, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if feeds[server.URL+"/advertised/rss.xml"] != "Advertised" || feeds[unadvertisedServer.URL+"/feed"] != "Unadvertised" || len(feeds) != 2 {
+		t.Errorf("Expected web pages to be replaced by their feeds in index.html but found %v", feeds)
+	}
+	if len(agg.Items) != 1 {
+		t.Errorf("Expected 1 item from the discovered feeds but found %d", len(agg.Items))
+	}
+
+	// A feed that worked before and answers with a web page just fails, it isn't replaced
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	mux.HandleFunc("/interstitial/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<!DOCTYPE html><html><head><link rel="alternate" type="application/rss+xml" href="/advertised/rss.xml"></head><body>Checking your browser</body></html>`)
+	})
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{server.URL + "/interstitial/feed": "Established"},
+		map[string]*FeedInfo{server.URL + "/interstitial/feed": {LastSuccess: time.Now().Add(-time.Hour)}}, 0))
+	failIfError(t, agg.Update())
+	_, feeds, feedInfos, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if info := feedInfos[server.URL+"/interstitial/feed"]; feeds[server.URL+"/interstitial/feed"] != "Established" || len(feeds) != 1 || info.Failures != 1 {
+		t.Errorf("Expected established feed answering with a web page to fail without being replaced but found %v %+v", feeds, info)
+	}
+}
+
+// Tests that dates, author, summary, source feed and first seen time are kept in index.html and read back
+func Test_ItemDetailsRoundTrip(t *testing.T) {
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title><item>
+			<title>One &amp; only</title><link>https://example.com/1</link>
+			<pubDate>Sat, 03 Jun 2023 10:00:00 GMT</pubDate><author>jane@example.com (Jane)</author>
+			<description>&lt;p&gt;Some &lt;b&gt;bold&lt;/b&gt;   summary&lt;/p&gt;</description>
+		</item></channel></rss>`), nil
+	})
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{"https://example.com/rss": "Example"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	failIfError(t, agg.Update())
+	items, _, _, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if len(items) != 1 {
+		t.Fatalf("Expected 1 item in index.html but found %d", len(items))
+	}
+	item := items[0]
+	if item.Title != "One & only" || item.URL != "https://example.com/1" || item.Tag != "example.com" {
+		t.Errorf("Expected title, URL and tag to be read back but found %+v", item)
+	}
+	if !item.PublishedAt.Equal(time.Date(2023, 6, 3, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected published date to be read back but found %s", item.PublishedAt)
+	}
+	if item.Author != "Jane" || item.Summary != "Some bold summary" || item.Feed != "https://example.com/rss" {
+		t.Errorf("Expected author, summary and feed to be read back but found %+v", item)
+	}
+	if time.Since(item.FirstSeen) > time.Minute {
+		t.Errorf("Expected first seen time to be about now but found %s", item.FirstSeen)
+	}
+}
+
+// Tests that with Chronological items found in one update are sorted by published date across feeds
+func Test_ChronologicalMerge(t *testing.T) {
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		xml := `<rss version="2.0"><channel><title>t</title>`
+		for _, day := range map[string][]int{"https://a.example.com/rss": {1, 3, 5}, "https://b.example.com/rss": {2, 4, 6}}[URL] {
+			xml += fmt.Sprintf(`<item><title>Day %d</title><link>%s?day=%d</link><pubDate>%s</pubDate></item>`,
+				day, URL, day, time.Date(2023, 6, day, 0, 0, 0, 0, time.UTC).Format(time.RFC1123Z))
+		}
+		return []byte(xml + `</channel></rss>`), nil
+	})
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", []Item{{Title: "Older", URL: "https://example.com/older"}}, map[string]string{
+		"https://a.example.com/rss": "A",
+		"https://b.example.com/rss": "B",
+	}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	agg.Chronological = true
+	failIfError(t, agg.Update())
+	titles := make([]string, 0)
+	for _, item := range agg.Items {
+		titles = append(titles, item.Title)
+	}
+	if strings.Join(titles, ", ") != "Day 6, Day 5, Day 4, Day 3, Day 2, Day 1, Older" {
+		t.Errorf("Expected new items sorted by date on top of older ones but found %s", strings.Join(titles, ", "))
+	}
+}
+
+// Tests that RSS, Atom and JSON Feed sources all go through Update alike, including their discussion links
+func Test_FeedFormats(t *testing.T) {
+	tests := []struct {
+		file           string
+		plainURL       string
+		articleURL     string
+		discussionURL  string
+		discussionItem string
+	}{
+		{"rss.xml", "https://rss.example.com/plain", "https://article.example.com/rss", "https://rss.example.com/discussion", "RSS item with comments"},
+		{"atom.xml", "https://atom.example.com/plain", "https://article.example.com/atom", "https://atom.example.com/discussion", "Atom entry with replies"},
+		{"feed.json", "https://json.example.com/plain", "https://article.example.com/json", "https://json.example.com/discussion", "JSON Feed link post"},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+				return os.ReadFile("test_data/formats/" + test.file)
+			})
+			dir := t.TempDir()
+			failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{"https://example.com/" + test.file: test.file}, nil, 0))
+			agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+			failIfError(t, err)
+			failIfError(t, agg.Update())
+			items, _, _, err := loadFromFile(dir + "/index.html")
+			failIfError(t, err)
+			if len(items) != 2 {
+				t.Fatalf("Expected 2 items but found %d", len(items))
+			}
+			if items[0].Title != test.discussionItem || items[0].URL != test.articleURL || items[0].DiscussionURL != test.discussionURL {
+				t.Errorf("Expected top item to be %q linking to %s and discussed at %s but found %+v", test.discussionItem, test.articleURL, test.discussionURL, items[0])
+			}
+			if items[1].URL != test.plainURL || items[1].DiscussionURL != "" || items[1].PublishedAt.IsZero() {
+				t.Errorf("Expected bottom item to link to %s only and have a published date but found %+v", test.plainURL, items[1])
+			}
+		})
+	}
+}
+
+// Tests that items keep both article and discussion links, that feeds can prefer the discussion as main link
+// and that items saved back when the discussion was their only URL aren't added again
+func Test_ArticleAndDiscussionLinks(t *testing.T) {
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title>
+			<item><title>Old</title><link>https://article.example.com/old</link><comments>` + URL + `/old</comments></item>
+			<item><title>New</title><link>https://article.example.com/new` + URL[8:9] + `</link><comments>` + URL + `/new</comments></item>
+		</channel></rss>`), nil
+	})
+	dir := t.TempDir()
+	failIfError(t, os.WriteFile(dir+"/index.html", []byte(`
+		<a class="feed" href="https://a.example.com">Article first</a>
+		<a class="feed" href="https://b.example.com" data-link="discussion">Discussion first</a>
+		<a class="item" href="https://a.example.com/old">Old</a>
+		<a class="item" href="https://b.example.com/old">Old</a>`), 0644))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	failIfError(t, agg.Update())
+	html, err := os.ReadFile(dir + "/index.html")
+	failIfError(t, err)
+	for _, expected := range []string{
+		`<a class="comments" target="_blank" href="https://a.example.com/new">comments</a>`,
+		`<a class="item" target="_blank" href="https://article.example.com/newa" data-discussion="https://a.example.com/new"`,
+		`<a class="comments" target="_blank" href="https://article.example.com/newb">article</a>`,
+		`<a class="item" target="_blank" href="https://b.example.com/new" data-article="https://article.example.com/newb"`,
+	} {
+		if !strings.Contains(string(html), expected) {
+			t.Errorf("Expected index.html to contain %s", expected)
+		}
+	}
+	items, _, _, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if len(items) != 4 {
+		t.Fatalf("Expected 2 new items on top of the 2 old ones but found %d", len(items))
+	}
+	for _, item := range items[:2] {
+		if !strings.HasPrefix(item.URL, "https://article.example.com/new") || !strings.HasSuffix(item.DiscussionURL, ".example.com/new") {
+			t.Errorf("Expected article and discussion links to be read back but found %+v", item)
+		}
+		if item.DiscussionFirst != strings.HasPrefix(item.DiscussionURL, "https://b.") {
+			t.Errorf("Expected only items from the feed preferring discussions to have the discussion as main link but found %+v", item)
+		}
+	}
+}
+
+// Tests that feeds in other encodings, declared either in the XML declaration or the Content-Type header, are transcoded
+// and that whitespace inside content survives cleaning
+func Test_CharsetDecoding(t *testing.T) {
+	rssWithTitle := func(declaration, title string) string {
+		return declaration + `<rss version="2.0"><channel><title>t</title><item><title>` + title + `</title><link>https://example.com/1</link>
+			<description>First line
+	second line` + "\x0b" + `</description></item></channel></rss>`
+	}
+	encode := func(enc encoding.Encoding, s string) string {
+		encoded, err := enc.NewEncoder().String(s)
+		failIfError(t, err)
+		return encoded
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		content     string
+		title       string
+	}{
+		{"utf-8", "text/xml", rssWithTitle(`<?xml version="1.0"?>`, "Café"), "Café"},
+		{"iso-8859-1 declaration", "text/xml", encode(charmap.ISO8859_1, rssWithTitle(`<?xml version="1.0" encoding="ISO-8859-1"?>`, "Café")), "Café"},
+		{"windows-1251 content type", "application/rss+xml; charset=windows-1251", encode(charmap.Windows1251, rssWithTitle(`<?xml version="1.0"?>`, "Новости")), "Новости"},
+		{"shift_jis declaration", "text/xml", encode(japanese.ShiftJIS, rssWithTitle(`<?xml version="1.0" encoding="Shift_JIS"?>`, "ニュース")), "ニュース"},
+		{"undeclared latin-1", "text/xml", encode(charmap.ISO8859_1, rssWithTitle(`<?xml version="1.0"?>`, "Café")), "Café"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				fmt.Fprint(w, test.content)
+			}))
+			defer server.Close()
+			agg := &Aggregator{log: logrus.New(), Fetcher: MakeURLFetcher(logrus.New(), 0, server.Client())}
+			body, contentType, err := agg.fetch(server.URL, &FeedInfo{})
+			failIfError(t, err)
+			items, _, err := agg.parseXML(decodeToUTF8(body, contentType))
+			failIfError(t, err)
+			if len(items) != 1 || items[0].Title != test.title {
+				t.Fatalf("Expected one item titled %q but found %+v", test.title, items)
+			}
+			if items[0].Summary != "First line second line" {
+				t.Errorf("Expected line breaks to survive as whitespace in the summary but found %q", items[0].Summary)
+			}
+		})
+	}
+}
+
+// Tests that web pages with data-scrape-* selectors in index.html are scraped for items and keep their selectors
+func Test_ScrapeSelectors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body>
+			<article><h2><a href="/posts/2">Newest post</a></h2><time datetime="2023-05-02T10:00:00Z">May 2</time></article>
+			<article><h2><a href="https://other.example.com/1">Oldest post</a></h2><span class="date">May 1, 2023</span></article>
+			<article><h2>No link</h2></article>
+		</body></html>`)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	failIfError(t, os.WriteFile(dir+"/index.html", []byte(`<a class="feed" href="`+server.URL+`/blog" data-scrape-item="article" data-scrape-title="h2" data-scrape-date="time, .date">Blog</a>`), 0644))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, MakeURLFetcher(logrus.New(), 0, http.DefaultClient))
+	failIfError(t, err)
+	failIfError(t, agg.Update())
+	if len(agg.Items) != 2 {
+		t.Fatalf("Expected 2 scraped items but found %d: %+v", len(agg.Items), agg.Items)
+	}
+	newest, oldest := agg.Items[0], agg.Items[1]
+	if newest.Title != "Newest post" {
+		newest, oldest = oldest, newest
+	}
+	if newest.Title != "Newest post" || newest.URL != server.URL+"/posts/2" || !newest.PublishedAt.Equal(time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected newest post with relative URL resolved but found %+v", newest)
+	}
+	if oldest.Title != "Oldest post" || oldest.URL != "https://other.example.com/1" || !oldest.PublishedAt.Equal(time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected oldest post with its text date but found %+v", oldest)
+	}
+	_, _, infos, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if scrape := infos[server.URL+"/blog"].Scrape; scrape == nil || *scrape != (ScrapeSelectors{Item: "article", Title: "h2", Date: "time, .date"}) {
+		t.Errorf("Expected scrape selectors to be kept in index.html but found %+v", scrape)
+	}
+}
+
+// Tests that scraped web pages in other encodings are decoded following their Content-Type or <meta charset>
+func Test_ScrapeEncodings(t *testing.T) {
+	encode := func(enc encoding.Encoding, s string) string {
+		encoded, err := enc.NewEncoder().String(s)
+		failIfError(t, err)
+		return encoded
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		page        string
+		title       string
+	}{
+		{"shift_jis meta charset", "text/html", encode(japanese.ShiftJIS, `<html><head><meta charset="Shift_JIS"></head><body><article><a href="/1">ニュース</a></article></body></html>`), "ニュース"},
+		{"windows-1251 content type", "text/html; charset=windows-1251", encode(charmap.Windows1251, `<html><body><article><a href="/1">Новости</a></article></body></html>`), "Новости"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				fmt.Fprint(w, test.page)
+			}))
+			defer server.Close()
+			dir := t.TempDir()
+			failIfError(t, os.WriteFile(dir+"/index.html", []byte(`<a class="feed" href="`+server.URL+`/news" data-scrape-item="article">News</a>`), 0644))
+			agg, err := NewWithCustom(logrus.New(), dir, 1000, MakeURLFetcher(logrus.New(), 0, server.Client()))
+			failIfError(t, err)
+			failIfError(t, agg.Update())
+			if len(agg.Items) != 1 || agg.Items[0].Title != test.title {
+				t.Errorf("Expected one scraped item titled %q but found %+v", test.title, agg.Items)
+			}
+		})
+	}
+}
+
+// Tests that file:// and exec: feeds are read from disk and from commands, keep their URLs in index.html and report command failures
+func Test_LocalSources(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh, cat and sleep")
+	}
+	dir := t.TempDir()
+	rss := []byte(`<rss version="2.0"><channel><title>t</title><item><title>From file</title><link>https://example.com/file</link></item></channel></rss>`)
+	rssFile := dir + "/local feed.xml"
+	failIfError(t, os.WriteFile(rssFile, rss, 0644))
+	failIfError(t, os.WriteFile(dir+"/feed.xml", rss, 0644))
+	failingScript := dir + "/failing.sh"
+	failIfError(t, os.WriteFile(failingScript, []byte("echo something broke >&2\nexit 3\n"), 0644))
+	fileURL := (&url.URL{Scheme: "file", Path: rssFile}).String()
+	execURL := "exec:cat " + dir + "/feed.xml"
+	failingURL := "exec:sh " + failingScript
+	slowURL := "exec:sleep 5"
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{
+		fileURL:    "File",
+		execURL:    "Command",
+		failingURL: "Failing",
+		slowURL:    "Slow",
+	}, nil, 0))
+	fetcher := MakeSourceFetcher(logrus.New(), 500*time.Millisecond, bodyFetcher(func(URL string) ([]byte, error) {
+		t.Errorf("Expected local sources not to be fetched over HTTP but %s was", URL)
+		return nil, nil
+	}))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	failIfError(t, agg.Update())
+	// Both sources publish the same item, which is only added once
+	if len(agg.Items) != 1 || agg.Items[0].Title != "From file" {
+		t.Errorf("Expected 1 item from local sources but found %+v", agg.Items)
+	}
+	_, feeds, infos, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if len(feeds) != 4 || feeds[fileURL] != "File" || feeds[normalizeSourceURL(execURL)] != "Command" {
+		t.Errorf("Expected local sources to keep their URLs in index.html but found %v", feeds)
+	}
+	if info := infos[normalizeSourceURL(execURL)]; info.Failures != 0 || info.LastSuccess.IsZero() {
+		t.Errorf("Expected successful command to be recorded as such but found %+v", info)
+	}
+	if info := infos[normalizeSourceURL(failingURL)]; info.Failures != 1 || !strings.Contains(info.LastError, "exit status 3") || !strings.Contains(info.LastError, "something broke") {
+		t.Errorf("Expected failing command to be recorded with its exit status and stderr but found %+v", info)
+	}
+	if info := infos[normalizeSourceURL(slowURL)]; info.Failures != 1 || !strings.Contains(info.LastError, "timed out") {
+		t.Errorf("Expected slow command to time out but found %+v", info)
+	}
+}
+
+// Tests that middlewares run in Chain order and that Retry and Cache do their job
+func Test_FetcherMiddlewares(t *testing.T) {
+	var calls int64
+	flaky := FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+		if atomic.AddInt64(&calls, 1) < 3 {
+			return &Response{URL: req.URL, StatusCode: http.StatusBadGateway}, nil
+		}
+		return &Response{URL: req.URL, StatusCode: http.StatusOK, Body: []byte("content")}, nil
+	})
+	order := make([]string, 0)
+	trace := func(name string) Middleware {
+		return func(next Fetcher) Fetcher {
+			return FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+				order = append(order, name)
+				return next.Fetch(ctx, req)
+			})
+		}
+	}
+	cacheDir := t.TempDir()
+	fetcher := Chain(flaky, trace("outer"), Cache(logrus.New(), cacheDir), trace("inner"), Retry(logrus.New(), 2, time.Millisecond))
+	resp, err := fetcher.Fetch(context.Background(), Request{URL: "https://example.com/rss"})
+	failIfError(t, err)
+	if resp.StatusCode != http.StatusOK || string(resp.Body) != "content" || calls != 3 {
+		t.Errorf("Expected 2 retries to get past the 502s but found status %d after %d calls", resp.StatusCode, calls)
+	}
+	resp, err = fetcher.Fetch(context.Background(), Request{URL: "https://example.com/rss"})
+	failIfError(t, err)
+	if string(resp.Body) != "content" || calls != 3 {
+		t.Errorf("Expected second request to be served from cache but found %q after %d calls", resp.Body, calls)
+	}
+	if strings.Join(order, ",") != "outer,inner,outer" {
+		t.Errorf("Expected middlewares to run outermost first and cache hits to stop the chain but found %s", strings.Join(order, ","))
+	}
+}
+
+// Tests that replaying a recorded update gives the same index.html every time, matching test_data/replay/expected.html.
+// After changes meant to alter index.html, regenerate it with: go test -run Test_ReplayGolden -update
+func Test_ReplayGolden(t *testing.T) {
+	fetcher, err := Replay("test_data/replay")
+	failIfError(t, err)
+	recordedAt, err := RecordedAt("test_data/replay")
+	failIfError(t, err)
+	if !recordedAt.Equal(time.Date(2023, 6, 2, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected recording to be dated from its first response but found %s", recordedAt)
+	}
+	outputs := make([]string, 0)
+	for run := 0; run < 2; run++ {
+		dir := t.TempDir()
+		agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+		failIfError(t, err)
+		failIfError(t, agg.LoadRecordedIndex("test_data/replay"))
+		agg.Clock = func() time.Time { return recordedAt }
+		agg.Shuffle = false
+		failIfError(t, agg.Update())
+		html, err := os.ReadFile(dir + "/index.html")
+		failIfError(t, err)
+		outputs = append(outputs, string(html))
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("Expected replayed updates to produce the same index.html")
+	}
+	if *updateGolden {
+		failIfError(t, os.WriteFile("test_data/replay/expected.html", []byte(outputs[0]), 0644))
+	}
+	expected, err := os.ReadFile("test_data/replay/expected.html")
+	failIfError(t, err)
+	if outputs[0] != string(expected) {
+		t.Errorf("Expected replayed index.html to match test_data/replay/expected.html but found:\n%s", outputs[0])
+	}
+}
+
+// Tests that the same article arriving under different URLs is only added once and linked to through a cleaned URL
+func Test_CanonicalURLs(t *testing.T) {
+	rules, err := ParseURLRules(strings.NewReader("# Comment\nexample.com strip=ref\n"))
+	failIfError(t, err)
+	tests := []struct {
+		URL   string
+		clean string
+	}{
+		{"https://example.com/news/1?utm_source=rss&utm_medium=feed", "https://example.com/news/1"},
+		{"HTTP://Example.com:80/news/1?id=2&fbclid=abc#top", "http://example.com/news/1?id=2#top"},
+		{"https://www.google.com/amp/s/example.com/news/1/", "https://example.com/news/1/"},
+		{"https://example-com.cdn.ampproject.org/c/s/example.com/news/1?utm_source=x", "https://example.com/news/1"},
+		{"https://github.com/ampproject/amp", "https://github.com/ampproject/amp"},
+		{"https://example.com/search?q=amp&amp=1", "https://example.com/search?q=amp&amp=1"},
+		{"https://blog.example.com/news/1?ref=home&page=2", "https://blog.example.com/news/1?page=2"},
+		{"https://www.youtube.com/watch?v=abc&feature=share&si=xyz", "https://www.youtube.com/watch?v=abc"},
+		{"exec:cat feed.xml?utm_source=x", "exec:cat feed.xml?utm_source=x"},
+	}
+	agg := &Aggregator{log: logrus.New()}
+	failIfError(t, agg.SetURLRules(rules))
+	for _, test := range tests {
+		if clean := cleanURL(test.URL, agg.rules()); clean != test.clean {
+			t.Errorf("Expected %s to be cleaned to %s but found %s", test.URL, test.clean, clean)
+		}
+	}
+	if key := canonicalKey("https://example.com/news/1/amp/?amp=1", agg.rules()); key != canonicalKey("https://example.com/news/1", agg.rules()) {
+		t.Errorf("Expected AMP versions of an article to be identified as the article but found %s", key)
+	}
+
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title>
+			<item><title>Via tracker</title><link>http://www.example.com/news/1/?utm_campaign=rss&amp;b=2&amp;a=1</link></item>
+			<item><title>Via AMP</title><link>https://www.google.com/amp/s/example.com/news/1/amp?a=1&amp;b=2&amp;amp=1</link></item>
+			<item><title>Original</title><link>https://example.com/news/1?a=1&amp;b=2</link></item>
+			<item><title>Already seen</title><link>https://example.com/old?utm_source=x</link></item>
+		</channel></rss>`), nil
+	})
+	dir := t.TempDir()
+	failIfError(t, os.WriteFile(dir+"/index.html", []byte(`<a class="feed" href="https://example.com/rss">Example</a>
+		<a class="item" href="https://www.example.com/old/">Old</a>`), 0644))
+	agg, err = NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	failIfError(t, agg.Update())
+	items, _, _, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if len(items) != 2 || items[0].URL != "http://www.example.com/news/1/?b=2&a=1" {
+		t.Errorf("Expected the first of the duplicates to be added, linking to its cleaned URL, on top of the old item but found %+v", items)
+	}
+}
+
+// Tests that items are known by GUID when feeds rotate links, that a reused URL with a new GUID is a new item
+// and that repeated GUIDs are ignored in favor of URLs
+func Test_GUIDIdentity(t *testing.T) {
+	update := 0
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		if URL == "https://repeats.example.com/rss" {
+			return []byte(`<rss version="2.0"><channel><title>t</title>
+				<item><title>A</title><link>https://repeats.example.com/a</link><guid>same</guid></item>
+				<item><title>B</title><link>https://repeats.example.com/b</link><guid>same</guid></item>
+			</channel></rss>`), nil
+		}
+		rotating := fmt.Sprintf("https://cdn%d.example.com/story?session=%d", update, update)
+		return []byte(`<rss version="2.0"><channel><title>t</title>
+			<item><title>Rotating link</title><link>` + rotating + `</link><guid isPermaLink="false">story-1</guid></item>
+			<item><title>Weekly post ` + fmt.Sprint(update) + `</title><link>https://example.com/weekly</link><guid>weekly-` + fmt.Sprint(update) + `</guid></item>
+			<item><title>Elsewhere</title><link>https://repeats.example.com/a</link><guid>elsewhere</guid></item>
+		</channel></rss>`), nil
+	})
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{"https://example.com/rss": "Example", "https://repeats.example.com/rss": "Repeats"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	agg.Shuffle = false
+	failIfError(t, agg.Update())
+	// A restart must pick GUIDs up from index.html
+	agg, err = NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	agg.Shuffle = false
+	update++
+	failIfError(t, agg.Update())
+	items, _, _, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	titles := make([]string, 0)
+	for _, item := range items {
+		titles = append(titles, item.Title)
+		if item.Feed == "https://repeats.example.com/rss" && item.GUID != "" {
+			t.Errorf("Expected repeated GUIDs to be dropped but found %+v", item)
+		}
+	}
+	// Rotating link is added once, the weekly post twice and A only under the title it had in the feed fetched first
+	sort.Strings(titles)
+	if strings.Join(titles, ", ") != "B, Elsewhere, Rotating link, Weekly post 0, Weekly post 1" {
+		t.Errorf("Expected items to be identified by GUID but found %s", strings.Join(titles, ", "))
+	}
+}
+
+// Tests that items about the same story from different feeds become one entry listing the other sources, across reloads
+func Test_StoryClustering(t *testing.T) {
+	feeds := map[string]string{
+		"https://news.example.com/rss": `<item><title>Spacecraft lands safely on the Moon's south pole</title><link>https://news.example.com/moon</link></item>
+			<item><title>Local bakery wins award</title><link>https://news.example.com/bakery</link></item>`,
+		"https://wire.example.org/rss": `<item><title>Spacecraft safely lands on Moon south pole</title><link>https://wire.example.org/moon-landing</link></item>`,
+		"https://hn.example.com/rss":   `<item><title>Moon landing</title><link>https://news.example.com/moon?utm_source=hn</link><comments>https://hn.example.com/item?id=1</comments></item>`,
+	}
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title>` + feeds[URL] + `</channel></rss>`), nil
+	})
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{
+		"https://news.example.com/rss": "News",
+		"https://wire.example.org/rss": "Wire",
+		"https://hn.example.com/rss":   "HN",
+	}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	agg.Shuffle = false
+	failIfError(t, agg.Update())
+	// Fetching again after a restart must not add the related items as entries or relate them twice
+	agg, err = NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	failIfError(t, agg.Update())
+	items, _, _, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if len(items) != 2 {
+		t.Fatalf("Expected the moon landing and the bakery as the only entries but found %+v", items)
+	}
+	var story Item
+	for _, item := range items {
+		if strings.Contains(item.Title, "Moon") {
+			story = item
+		}
+	}
+	tags := make([]string, 0)
+	for _, related := range story.Related {
+		tags = append(tags, related.Tag+" "+related.URL)
+	}
+	sort.Strings(tags)
+	if story.Feed != "https://hn.example.com/rss" || strings.Join(tags, ", ") != "news.example.com https://news.example.com/moon, wire.example.org https://wire.example.org/moon-landing" {
+		t.Errorf("Expected the story to list the other sources as related but found %+v", story)
+	}
+}
+
+// Tests that with RefreshKnownItems, corrected titles and newer update times of known items replace the saved ones in place
+func Test_RefreshKnownItems(t *testing.T) {
+	items := `<item><guid>1</guid><title>Mayor resigns</title><link>https://example.com/1</link></item>
+		<item><guid>2</guid><title>Storm on the way</title><link>https://example.com/2</link></item>`
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title>` + items + `</channel></rss>`), nil
+	})
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{"https://example.com/rss": "Example"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	failIfError(t, agg.Update())
+
+	items = `<item><guid>3</guid><title>Roads closed</title><link>https://example.com/3</link></item>
+		<item><guid>1</guid><title>Mayor resigns</title><link>https://example.com/1</link></item>
+		<item><guid>2</guid><title>Storm on the way [updated]</title><link>https://example.com/2?utm_source=rss</link></item>`
+	// Off by default
+	failIfError(t, agg.Update())
+	if agg.Items[len(agg.Items)-1].Title == "Storm on the way [updated]" || agg.Items[len(agg.Items)-2].Title == "Storm on the way [updated]" {
+		t.Errorf("Expected titles of known items to be left alone by default but found %+v", agg.Items)
+	}
+
+	agg, err = NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	agg.RefreshKnownItems, agg.MarkRefreshed = true, true
+	refreshedAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	agg.Clock = func() time.Time { return refreshedAt }
+	failIfError(t, agg.Update())
+	saved, _, _, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	titles := make([]string, 0)
+	for _, item := range saved {
+		titles = append(titles, item.Title)
+	}
+	if len(saved) != 3 || saved[0].Title != "Roads closed" {
+		t.Fatalf("Expected refreshed items to keep their place below the new one but found %q", titles)
+	}
+	for _, item := range saved {
+		refreshed := item.GUID == "2"
+		if refreshed && (item.Title != "Storm on the way [updated]" || !item.RefreshedAt.Equal(refreshedAt)) {
+			t.Errorf("Expected item 2 to be refreshed and marked but found %+v", item)
+		}
+		if !refreshed && !item.RefreshedAt.IsZero() {
+			t.Errorf("Expected only item 2 to be marked as refreshed but found %+v", item)
+		}
+	}
+	content, err := os.ReadFile(dir + "/index.html")
+	failIfError(t, err)
+	if strings.Count(string(content), `<span class="refreshed">updated</span>Storm on the way [updated]</a>`) != 1 {
+		t.Errorf("Expected refreshed item to be labeled as updated but found:\n%s", content)
+	}
+}
+
+// Tests that html files are replaced atomically, keeping previous versions as rotating backups,
+// and that failed writes leave the file as it was
+func Test_AtomicPageWrites(t *testing.T) {
+	dir := t.TempDir()
+	file := dir + "/index.html"
+	for i := 1; i <= pageBackups+2; i++ {
+		failIfError(t, writeFileAtomically(file, pageBackups, func(w io.Writer) error {
+			_, err := fmt.Fprintf(w, "version %d", i)
+			return err
+		}))
+	}
+	expected := map[string]string{file: fmt.Sprintf("version %d", pageBackups+2)}
+	for n := 1; n <= pageBackups; n++ {
+		expected[backupName(file, n)] = fmt.Sprintf("version %d", pageBackups+2-n)
+	}
+	for name, content := range expected {
+		found, err := os.ReadFile(name)
+		failIfError(t, err)
+		if string(found) != content {
+			t.Errorf("Expected %s to contain %q but found %q", name, content, found)
+		}
+	}
+	if fileExists(backupName(file, pageBackups+1)) {
+		t.Errorf("Expected only %d backups but found %s", pageBackups, backupName(file, pageBackups+1))
+	}
+	if runtime.GOOS != "windows" {
+		stat, err := os.Stat(file)
+		failIfError(t, err)
+		if stat.Mode().Perm() != 0644 {
+			t.Errorf("Expected new files to be created with mode 0644 but found %s", stat.Mode())
+		}
+		failIfError(t, os.Chmod(file, 0640))
+		failIfError(t, writeFileAtomically(file, 0, func(w io.Writer) error {
+			_, err := fmt.Fprint(w, expected[file])
+			return err
+		}))
+		stat, err = os.Stat(file)
+		failIfError(t, err)
+		if stat.Mode().Perm() != 0640 {
+			t.Errorf("Expected replaced files to keep their mode 0640 but found %v", stat.Mode())
+		}
+	}
+
+	err := writeFileAtomically(file, pageBackups, func(w io.Writer) error {
+		fmt.Fprint(w, "half written")
+		return fmt.Errorf("crash")
+	})
+	if err == nil {
+		t.Errorf("Expected write error to be returned")
+	}
+	found, err := os.ReadFile(file)
+	failIfError(t, err)
+	if string(found) != expected[file] {
+		t.Errorf("Expected %s to be left as it was after a failed write but found %q", file, found)
+	}
+	entries, err := os.ReadDir(dir)
+	failIfError(t, err)
+	if len(entries) != pageBackups+1 {
+		t.Errorf("Expected temp files to be cleaned up but found %d files", len(entries))
+	}
+}
+
+// Tests that index.html is backed up once per update however many feeds it has, so backups go back several updates
+func Test_IndexBackedUpOncePerUpdate(t *testing.T) {
+	update := 0
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(fmt.Sprintf(`<rss version="2.0"><channel><title>t</title><item><title>Update %d</title><link>%s/%d</link></item></channel></rss>`, update, URL, update)), nil
+	})
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{
+		"https://a.example.com/rss": "A", "https://b.example.com/rss": "B", "https://c.example.com/rss": "C",
+		"https://d.example.com/rss": "D", "https://e.example.com/rss": "E"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	agg.MinInterval, agg.DefaultInterval = 0, 0
+	for update = 1; update <= pageBackups; update++ {
+		failIfError(t, agg.Update())
+	}
+	for n := 1; n <= pageBackups; n++ {
+		items, _, _, err := loadFromFile(backupName(dir+"/index.html", n))
+		failIfError(t, err)
+		if expected := 5 * (pageBackups - n); len(items) != expected {
+			t.Errorf("Expected %s to be from before update %d with %d items but found %d", backupName(dir+"/index.html", n), pageBackups-n+1, expected, len(items))
+		}
+	}
+}
+
+// Tests that an emptied or missing index.html is restored from its newest backup, or from the feeds listed in pageN.html
+func Test_IndexRecovery(t *testing.T) {
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title><item><title>Hello</title><link>https://example.com/1</link></item></channel></rss>`), nil
+	})
+	feeds := map[string]string{"https://example.com/rss": "Example"}
+	newAggregator := func(dir string) *Aggregator {
+		agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+		failIfError(t, err)
+		agg.MinInterval, agg.DefaultInterval = 0, 0
+		return agg
+	}
+	expectFeeds := func(dir string, items int) {
+		t.Helper()
+		saved, savedFeeds, _, err := loadFromFile(dir + "/index.html")
+		failIfError(t, err)
+		if len(savedFeeds) != 1 || savedFeeds["https://example.com/rss"] != "Example" || len(saved) != items {
+			t.Errorf("Expected index.html to be restored with its feed and %d items but found %v and %+v", items, savedFeeds, saved)
+		}
+	}
+
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, feeds, nil, 0))
+	agg := newAggregator(dir)
+	failIfError(t, agg.Update())
+	failIfError(t, os.WriteFile(dir+"/index.html", nil, 0644))
+	failIfError(t, agg.Update())
+	expectFeeds(dir, 1)
+	if content, err := os.ReadFile(dir + "/index.html.corrupt"); err != nil || len(content) != 0 {
+		t.Errorf("Expected the emptied index.html to be kept as index.html.corrupt but found %q, %v", content, err)
+	}
+
+	// Without backups feeds come from pages and news are fetched again
+	dir = t.TempDir()
+	failIfError(t, savePageToFile(dir+"/page2.html", []Item{{Title: "Old", URL: "https://example.com/old"}}, feeds, nil, 1))
+	failIfError(t, os.WriteFile(dir+"/index.html", []byte("<html><body>"), 0644))
+	agg = newAggregator(dir)
+	failIfError(t, agg.Update())
+	expectFeeds(dir, 1)
+	// The newest backup is from before the news were fetched again
+	failIfError(t, os.Remove(dir+"/index.html"))
+	agg = newAggregator(dir)
+	expectFeeds(dir, 0)
+	failIfError(t, agg.Update())
+	expectFeeds(dir, 1)
+
+	dir = t.TempDir()
+	failIfError(t, os.WriteFile(dir+"/index.html", nil, 0644))
+	if err := newAggregator(dir).Update(); err == nil || !strings.Contains(err.Error(), "zero feed sources") {
+		t.Errorf("Expected update to fail when there's nothing to restore from but found %v", err)
+	}
+}
+
+// Tests that sync conflict copies of index.html are merged into it and moved out of the way
+func Test_ConflictCopiesMerged(t *testing.T) {
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title></channel></rss>`), nil
+	})
+	dir := t.TempDir()
+	seen := time.Date(2023, 6, 2, 12, 0, 0, 0, time.UTC)
+	failIfError(t, savePageToFile(dir+"/index.html", []Item{
+		{Title: "Newer", URL: "https://a.example.com/3", FirstSeen: seen.Add(2 * time.Hour)},
+		{Title: "Oldest", URL: "https://a.example.com/1", FirstSeen: seen},
+	}, map[string]string{"https://a.example.com/rss": "A"}, nil, 0))
+	// The copy is older than the split into page2.html, so it still has the archived news
+	failIfError(t, savePageToFile(dir+"/page2.html", []Item{
+		{Title: "Archived", URL: "https://a.example.com/0", FirstSeen: seen.Add(-time.Hour)},
+	}, map[string]string{"https://a.example.com/rss": "A"}, nil, 1))
+	failIfError(t, savePageToFile(dir+"/index (1).html", []Item{
+		{Title: "Middle", URL: "https://b.example.com/2", FirstSeen: seen.Add(time.Hour)},
+		{Title: "Oldest", URL: "http://www.a.example.com/1/?utm_source=rss", FirstSeen: seen},
+		{Title: "Archived", URL: "https://a.example.com/0", FirstSeen: seen.Add(-time.Hour)},
+	}, map[string]string{"https://a.example.com/rss": "A", "https://b.example.com/rss": "B"}, nil, 0))
+	failIfError(t, savePageToFile(dir+"/index (Jane's conflicted copy 2023-06-02).html", nil,
+		map[string]string{"https://c.example.com/rss": "C"}, nil, 0))
+	failIfError(t, savePageToFile(dir+"/index-old.html", nil, map[string]string{"https://d.example.com/rss": "D"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	failIfError(t, agg.Update())
+
+	items, feeds, _, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	titles := make([]string, 0)
+	for _, item := range items {
+		titles = append(titles, item.Title)
+	}
+	if strings.Join(titles, ", ") != "Newer, Middle, Oldest" {
+		t.Errorf("Expected news from both copies without duplicates, even of pages, in the order they arrived but found %q", titles)
+	}
+	feedURLs := sortedMapKeys(feeds)
+	if strings.Join(feedURLs, " ") != "https://a.example.com/rss https://b.example.com/rss https://c.example.com/rss" {
+		t.Errorf("Expected feeds of all copies but found %q", feedURLs)
+	}
+	if copies := conflictCopies(dir); len(copies) != 0 {
+		t.Errorf("Expected merged copies to be moved away but found %q", copies)
+	}
+	archived, err := os.ReadDir(dir + "/conflicts")
+	failIfError(t, err)
+	if len(archived) != 2 || !fileExists(dir+"/index-old.html") {
+		t.Errorf("Expected both conflict copies and only them in conflicts but found %d files", len(archived))
+	}
+}
+
+// Tests that news directories are locked against other instances, on this machine and on others through leases,
+// that stale leases can be taken over and that read-only instances can run alongside without writing
+func Test_DirectoryLock(t *testing.T) {
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title><item><title>Hello</title><link>https://example.com/1</link></item></channel></rss>`), nil
+	})
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{"https://example.com/rss": "Example"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	lease, err := readLease(dir)
+	failIfError(t, err)
+	if lease.PID != os.Getpid() || time.Since(lease.Heartbeat) > time.Minute {
+		t.Errorf("Expected a fresh lease of this process but found %+v", lease)
+	}
+	if runtime.GOOS != "windows" {
+		if _, err := lockFile(dir + "/" + lockFileName); err != errLocked {
+			t.Errorf("Expected the directory to be locked for other processes but found %v", err)
+		}
+	}
+	agg.Close()
+	if fileExists(dir + "/" + leaseFileName) {
+		t.Errorf("Expected lease to be removed on Close")
+	}
+
+	writeLease := func(heartbeat time.Time) {
+		content, err := json.Marshal(Lease{Host: "laptop", PID: 42, Heartbeat: heartbeat})
+		failIfError(t, err)
+		failIfError(t, os.WriteFile(dir+"/"+leaseFileName, content, 0644))
+	}
+	writeLease(time.Now())
+	for _, mode := range []LockMode{Exclusive, TakeOver} {
+		var lockedErr *LockedError
+		if _, err := NewWithLock(logrus.New(), dir, 1000, fetcher, mode); !errors.As(err, &lockedErr) || lockedErr.Lease.Host != "laptop" {
+			t.Errorf("Expected mode %d to fail while another machine holds a fresh lease but found %v", mode, err)
+		}
+	}
+	before, err := os.ReadFile(dir + "/index.html")
+	failIfError(t, err)
+	readOnly, err := NewWithLock(logrus.New(), dir, 1000, fetcher, ReadOnly)
+	failIfError(t, err)
+	failIfError(t, readOnly.Update())
+	after, err := os.ReadFile(dir + "/index.html")
+	failIfError(t, err)
+	if string(before) != string(after) || len(readOnly.Items) != 1 {
+		t.Errorf("Expected read-only instance to fetch news without writing them but found %+v", readOnly.Items)
+	}
+
+	writeLease(time.Now().Add(-2 * leaseTimeout))
+	if _, err := NewWithCustom(logrus.New(), dir, 1000, fetcher); err == nil || !strings.Contains(err.Error(), "-takeover") {
+		t.Errorf("Expected stale lease to need taking over but found %v", err)
+	}
+	agg, err = NewWithLock(logrus.New(), dir, 1000, fetcher, TakeOver)
+	failIfError(t, err)
+	defer agg.Close()
+	if lease, err := readLease(dir); err != nil || lease.PID != os.Getpid() {
+		t.Errorf("Expected stale lease to be taken over but found %+v, %v", lease, err)
+	}
+
+	unreadable := t.TempDir()
+	failIfError(t, os.Mkdir(unreadable+"/index.html", 0755))
+	if _, err := NewWithCustom(logrus.New(), unreadable, 1000, fetcher); err == nil || fileExists(unreadable+"/"+leaseFileName) {
+		t.Errorf("Expected failing to open a directory to give its lock back but found %v", err)
+	}
+	agg.lock.lost.Store(true)
+	if err := agg.Run(nil); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected Run to stop once the lease was taken over but found %v", err)
+	}
+}
+
+// Tests that an update stops writing as soon as another machine takes the directory over, even between two feeds
+func Test_LeaseLostDuringUpdate(t *testing.T) {
+	dir := t.TempDir()
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		if URL == "https://b.example.com/rss" {
+			// Taken over once the first feed was saved
+			for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+				if content, _ := os.ReadFile(dir + "/index.html"); strings.Contains(string(content), "https://a.example.com/1") {
+					break
+				}
+			}
+			content, err := json.Marshal(Lease{Host: "laptop", PID: 42, Heartbeat: time.Now()})
+			if err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(dir+"/"+leaseFileName, content, 0644); err != nil {
+				return nil, err
+			}
+		}
+		return []byte(`<rss version="2.0"><channel><title>t</title><item><title>Hello</title><link>` + strings.TrimSuffix(URL, "rss") + `1</link></item></channel></rss>`), nil
+	})
+	failIfError(t, savePageToFile(dir+"/index.html", nil, map[string]string{"https://a.example.com/rss": "A", "https://b.example.com/rss": "B"}, nil, 0))
+	agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+	failIfError(t, err)
+	defer agg.Close()
+	agg.Shuffle = false
+	seen, err := os.ReadFile(dir + "/" + seenIndexFileName)
+	failIfError(t, err)
+	if err := agg.Update(); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected update to stop once the lease was taken over but found %v", err)
+	}
+	items, _, _, err := loadFromFile(dir + "/index.html")
+	failIfError(t, err)
+	if len(items) != 1 || items[0].URL != "https://a.example.com/1" {
+		t.Errorf("Expected only news saved before the lease was taken over in index.html but found %+v", items)
+	}
+	if after, err := os.ReadFile(dir + "/" + seenIndexFileName); err != nil || string(after) != string(seen) {
+		t.Errorf("Expected the seen index not to be saved once the lease was taken over, %v", err)
+	}
+}
+
+// Tests that known items are remembered through the seen index without reading pageN.html, which is only done
+// to rebuild the index when pages change, and that the index survives saving and forgets what wasn't seen for long
+func Test_SeenIndex(t *testing.T) {
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title><item><title>Archived</title><link>https://example.com/archived</link></item></channel></rss>`), nil
+	})
+	feeds := map[string]string{"https://example.com/rss": "Example"}
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, feeds, nil, 2))
+	failIfError(t, savePageToFile(dir+"/page2.html", []Item{{Title: "Archived", URL: "https://example.com/archived"}}, feeds, nil, 1))
+	update := func() []Item {
+		agg, err := NewWithCustom(logrus.New(), dir, 1000, fetcher)
+		failIfError(t, err)
+		defer agg.Close()
+		agg.MinInterval, agg.DefaultInterval = 0, 0
+		failIfError(t, agg.Update())
+		items, _, _, err := loadFromFile(dir + "/index.html")
+		failIfError(t, err)
+		return items
+	}
+	if items := update(); len(items) != 0 || !fileExists(dir+"/"+seenIndexFileName) {
+		t.Fatalf("Expected archived item to be known and the seen index to be saved but found %+v", items)
+	}
+	// Pages aren't read while the seen index covers them
+	failIfError(t, savePageToFile(dir+"/page2.html", nil, feeds, nil, 1))
+	if items := update(); len(items) != 0 {
+		t.Errorf("Expected archived item to be known from the seen index but found %+v", items)
+	}
+	// A new page makes the index out of date, so it's rebuilt from pages, which no longer have the item
+	failIfError(t, savePageToFile(dir+"/page3.html", nil, feeds, nil, 2))
+	if items := update(); len(items) != 1 {
+		t.Errorf("Expected seen index to be rebuilt from pages but found %+v", items)
+	}
+
+	index := newSeenIndex()
+	index.add("https://example.com/old", 100)
+	index.add("https://example.com/new", 200)
+	index.setGUIDFeed("https://example.com/new", "https://example.com/rss")
+	index.pages, index.rules = 3, 42
+	var buf strings.Builder
+	failIfError(t, index.writeTo(&buf))
+	loaded, err := readSeenIndex(strings.NewReader(buf.String()))
+	failIfError(t, err)
+	if feed, found := loaded.guidFeed("https://example.com/new"); !found || feed != hashKey("https://example.com/rss") || loaded.pages != 3 || loaded.rules != 42 {
+		t.Errorf("Expected seen index to be read back as saved but found %+v", loaded)
+	}
+	if _, err := readSeenIndex(strings.NewReader(buf.String()[:buf.Len()-3])); err == nil {
+		t.Errorf("Expected truncated seen index to fail")
+	}
+	if forgotten := loaded.forget(150); forgotten != 1 || loaded.has("https://example.com/old", 300) || !loaded.has("https://example.com/new", 300) {
+		t.Errorf("Expected only identities not seen since day 150 to be forgotten but found %+v", loaded)
+	}
+}
+
+// Tests that restarting with custom URL rules uses the seen index saved under them instead of reading pages again
+func Test_SeenIndexWithURLRules(t *testing.T) {
+	fetcher := bodyFetcher(func(URL string) ([]byte, error) {
+		return []byte(`<rss version="2.0"><channel><title>t</title><item><title>Archived</title><link>https://example.com/archived?ref=rss</link></item></channel></rss>`), nil
+	})
+	rules, err := ParseURLRules(strings.NewReader("example.com strip=ref\n"))
+	failIfError(t, err)
+	feeds := map[string]string{"https://example.com/rss": "Example"}
+	dir := t.TempDir()
+	failIfError(t, savePageToFile(dir+"/index.html", nil, feeds, nil, 2))
+	failIfError(t, savePageToFile(dir+"/page2.html", []Item{{Title: "Archived", URL: "https://example.com/archived"}}, feeds, nil, 1))
+	update := func() []Item {
+		agg, err := NewWithRules(logrus.New(), dir, 1000, fetcher, Exclusive, rules)
+		failIfError(t, err)
+		defer agg.Close()
+		failIfError(t, agg.SetURLRules(rules))
+		agg.MinInterval, agg.DefaultInterval = 0, 0
+		failIfError(t, agg.Update())
+		return agg.Items
+	}
+	if items := update(); len(items) != 0 {
+		t.Fatalf("Expected archived item to be known under the custom rules but found %+v", items)
+	}
+	// Emptying page2.html shows whether it's read again
+	failIfError(t, savePageToFile(dir+"/page2.html", nil, feeds, nil, 1))
+	if items := update(); len(items) != 0 {
+		t.Errorf("Expected archived item to be known from the seen index without reading page2.html but found %+v", items)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update golden files in test_data")
+
 var fakeFeedItemID = int64(0)
 
 // fakeURLFetcher generates fake items with incrementing IDs.
 // It always return 2 old items and 2 new items
-func fakeURLFetcher(URL string) (content []byte, err error) {
+var fakeURLFetcher = FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
 	agg := &Aggregator{
-		Feeds: map[string]string{URL: "Title of " + URL},
+		Feeds: map[string]string{req.URL: "Title of " + req.URL},
 		Items: make([]Item, 0),
 	}
-	atomic.AddInt64(&fakeFeedItemID, 2)
-	for i := fakeFeedItemID - 2; i < fakeFeedItemID+2; i++ {
+	lastID := atomic.AddInt64(&fakeFeedItemID, 2)
+	for i := lastID - 2; i < lastID+2; i++ {
 		agg.Items = append(agg.Items, Item{
 			Title: fmt.Sprintf("Item %d Title", i),
-			URL:   fmt.Sprintf("%s?item=%d", URL, i),
+			URL:   fmt.Sprintf("%s?item=%d", req.URL, i),
 		})
 	}
-	return []byte(toRSSXML(agg)), nil
+	return &Response{URL: req.URL, StatusCode: http.StatusOK, Body: []byte(toRSSXML(agg))}, nil
+})
+
+// bodyFetcher is a Fetcher answering every request with 200 and whatever body returns, or failing with its error
+func bodyFetcher(body func(URL string) ([]byte, error)) Fetcher {
+	return FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+		content, err := body(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{URL: req.URL, StatusCode: http.StatusOK, Body: content}, nil
+	})
 }
 
 // toRSSXML is used for testing. It returns an RSS XML string containing a randomly
@@ -0,0 +1,96 @@
+package feed
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// FeedInfo holds per-feed bookkeeping. It is stored as data-* attributes on the .feed anchors of index.html so it survives restarts.
+type FeedInfo struct {
+	// ETag and LastModified are the cache validators sent back to the server so unchanged feeds answer 304 Not Modified
+	ETag         string
+	LastModified string
+	// Failures counts consecutive failed fetches. It is reset by any successful fetch.
+	Failures    int
+	LastError   string
+	LastSuccess time.Time
+	// RetryAt is when a failing feed may be fetched again
+	RetryAt time.Time
+	// Disabled feeds are never fetched. Users re-enable them by removing data-disabled from index.html.
+	Disabled bool
+	// Gone is set when the feed answered 410 Gone. Such feeds are disabled as well.
+	Gone bool
+	// Hints are the publisher's refresh hints as of the last successful fetch
+	Hints RefreshHints
+	// Interval is set by users in index.html to fetch a feed at its own pace regardless of refresh hints
+	Interval time.Duration
+	// PreferDiscussion is set by users in index.html with data-link="discussion" to make discussion threads the main link of items
+	PreferDiscussion bool
+	// Scrape is set by users in index.html for web pages without a feed. Nil for regular feeds.
+	Scrape *ScrapeSelectors
+	// NextFetch is when the feed is due again according to Interval or its refresh hints
+	NextFetch time.Time
+	// MovedTo is set when the feed was permanently redirected or discovered from a web page. It is not persisted, Update renames the feed instead.
+	MovedTo string
+}
+
+// ErrNotModified is returned by URL fetchers when the server says the feed hasn't changed since it was last fetched
+var ErrNotModified = errors.New("feed not modified since last fetch")
+
+// maxFailureBackoff caps the exponential backoff so even long failing feeds are retried daily until disabled
+const maxFailureBackoff = 24 * time.Hour
+
+func (info *FeedInfo) recordSuccess(now time.Time) {
+	info.Failures = 0
+	info.LastError = ""
+	info.LastSuccess = now
+	info.RetryAt = time.Time{}
+}
+
+// recordFailure bumps the failure count and schedules the next attempt backoff * 2^(failures-1) from now.
+// Returns true if this failure disabled the feed.
+func (info *FeedInfo) recordFailure(err error, now time.Time, backoff time.Duration, maxFailures int) (disabled bool) {
+	info.Failures++
+	info.LastError = err.Error()
+	wait := backoff
+	for i := 1; i < info.Failures && wait < maxFailureBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxFailureBackoff {
+		wait = maxFailureBackoff
+	}
+	info.RetryAt = now.Add(wait)
+	if maxFailures > 0 && info.Failures >= maxFailures && !info.Disabled {
+		info.Disabled = true
+		return true
+	}
+	return false
+}
+
+// atoiOr parses s as an integer, returning fallback when it can't
+func atoiOr(s string, fallback int) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return fallback
+	}
+	return i
+}
+
+// parseTimeOr parses s as an RFC 3339 time, returning fallback when it can't
+func parseTimeOr(s string, fallback time.Time) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fallback
+	}
+	return t
+}
+
+// parseDurationOr parses s as a Go duration such as "1h30m0s", returning fallback when it can't
+func parseDurationOr(s string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,245 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/corpix/uarand"
+	"github.com/kennygrant/sanitize"
+	"github.com/sirupsen/logrus"
+)
+
+// Fetcher retrieves feed contents. Implementations return a Response for any status the source answers with
+// and an error only when there's no response at all, such as a connection failure.
+// See MakeURLFetcher() for the default one and Middleware for adding behavior to any Fetcher.
+type Fetcher interface {
+	Fetch(ctx context.Context, req Request) (*Response, error)
+}
+
+// FetcherFunc lets ordinary functions be used as a Fetcher
+type FetcherFunc func(ctx context.Context, req Request) (*Response, error)
+
+// Fetch calls f(ctx, req)
+func (f FetcherFunc) Fetch(ctx context.Context, req Request) (*Response, error) {
+	return f(ctx, req)
+}
+
+// Request describes what to fetch. ETag and LastModified are the validators of the previous fetch, if any,
+// which HTTP fetchers send along so unchanged feeds can be answered with 304.
+type Request struct {
+	URL          string
+	ETag         string
+	LastModified string
+}
+
+// Response is what a Fetcher got back
+type Response struct {
+	// URL is where the content was found, after following redirects
+	URL string
+	// MovedPermanently is set when URL differs from the requested one and every redirect on the way was permanent
+	MovedPermanently bool
+	StatusCode       int
+	Header           http.Header
+	Body             []byte
+	// Duration is how long the request took
+	Duration time.Duration
+}
+
+// Middleware wraps a Fetcher to add behavior such as rate limiting or caching
+type Middleware func(next Fetcher) Fetcher
+
+// Chain wraps f with middlewares. The first middleware is the outermost one, so it sees requests first and responses last.
+func Chain(f Fetcher, middlewares ...Middleware) Fetcher {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		f = middlewares[i](f)
+	}
+	return f
+}
+
+// httpFetcher is the bare HTTP Fetcher. MakeURLFetcher() adds rate limiting on top of it.
+type httpFetcher struct {
+	client *http.Client
+}
+
+func (f *httpFetcher) Fetch(ctx context.Context, request Request) (*Response, error) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, "GET", request.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create GET request to URL %s : %s", request.URL, err)
+	}
+	req.Header.Set("User-Agent", uarand.GetRandom())
+	req.Header.Set("Accept", "application/xml")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	if request.ETag != "" {
+		req.Header.Set("If-None-Match", request.ETag)
+	}
+	if request.LastModified != "" {
+		req.Header.Set("If-Modified-Since", request.LastModified)
+	}
+
+	// A feed has moved for good only if every redirect on the way was permanent
+	permanentRedirect := true
+	redirectAwareClient := *f.client
+	redirectAwareClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if code := req.Response.StatusCode; code != http.StatusMovedPermanently && code != http.StatusPermanentRedirect {
+			permanentRedirect = false
+		}
+		if f.client.CheckRedirect != nil {
+			return f.client.CheckRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}
+	resp, err := redirectAwareClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not open URL %s : %s", request.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read body of URL %s : %s", request.URL, err)
+	}
+	finalURL := resp.Request.URL.String()
+	return &Response{
+		URL:              finalURL,
+		MovedPermanently: permanentRedirect && finalURL != request.URL,
+		StatusCode:       resp.StatusCode,
+		Header:           resp.Header,
+		Body:             body,
+		Duration:         time.Since(start),
+	}, nil
+}
+
+// RateLimit serializes requests to the same host and spaces them by minInterval. Hosts answering 429 or 503 with
+// a Retry-After header are left alone until then: requests to them fail right away with a *hostDelayedError.
+func RateLimit(log *logrus.Logger, minInterval time.Duration) Middleware {
+	return func(next Fetcher) Fetcher {
+		limiter := newHostLimiter(log, minInterval)
+		return FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+			release, err := limiter.acquire(req.URL)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			resp, err := next.Fetch(ctx, req)
+			if err == nil {
+				if statusErr := newStatusError(req.URL, resp); !statusErr.RetryAt.IsZero() {
+					limiter.delay(req.URL, statusErr)
+				}
+			}
+			return resp, err
+		})
+	}
+}
+
+// Retry tries again up to attempts times when a request fails or the server answers with a 5xx status
+// that doesn't come with a Retry-After header. The wait between tries doubles every time.
+func Retry(log *logrus.Logger, attempts int, wait time.Duration) Middleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+			resp, err := next.Fetch(ctx, req)
+			for attempt := 1; attempt <= attempts && shouldRetry(resp, err); attempt++ {
+				log.Debugf("%s : retrying in %s, attempt %d of %d", req.URL, wait, attempt, attempts)
+				select {
+				case <-ctx.Done():
+					return resp, err
+				case <-time.After(wait):
+				}
+				wait *= 2
+				resp, err = next.Fetch(ctx, req)
+			}
+			return resp, err
+		})
+	}
+}
+
+// shouldRetry tells temporary failures apart from answers that won't change by asking again right away
+func shouldRetry(resp *Response, err error) bool {
+	var statusErr *StatusError
+	var delayedErr *hostDelayedError
+	if errors.As(err, &statusErr) || errors.As(err, &delayedErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500 && resp.Header.Get("Retry-After") == ""
+}
+
+// Logging logs every request along with its status and how long it took
+func Logging(log *logrus.Logger) Middleware {
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+			start := time.Now()
+			resp, err := next.Fetch(ctx, req)
+			if err != nil {
+				log.Debugf("%s : failed after %s: %s", req.URL, time.Since(start).Round(time.Millisecond), err)
+				return resp, err
+			}
+			log.Debugf("%s : %d %s in %s", req.URL, resp.StatusCode, http.StatusText(resp.StatusCode), time.Since(start).Round(time.Millisecond))
+			return resp, err
+		})
+	}
+}
+
+// Cache keeps the body of successful responses in dir and serves them from there afterwards, never asking again.
+// It was used during initial phases of development to prevent spamming feed sources.
+func Cache(log *logrus.Logger, dir string) Middleware {
+	dir = filepath.Clean(dir)
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+			fileName := dir + "/" + sanitize.BaseName(req.URL) + ".html"
+			if fileExists(fileName) {
+				log.Debugf("Cached %s", fileName)
+				body, err := os.ReadFile(fileName)
+				if err != nil {
+					return nil, fmt.Errorf("error opening cache %s : %s", req.URL, err)
+				}
+				return &Response{URL: req.URL, StatusCode: http.StatusOK, Body: body}, nil
+			}
+			log.Debugf("Web %s", req.URL)
+			// Validators would get a 304 with nothing to cache
+			resp, err := next.Fetch(ctx, Request{URL: req.URL})
+			if err != nil || resp.StatusCode != http.StatusOK {
+				return resp, err
+			}
+			if err := os.WriteFile(fileName, resp.Body, 0644); err != nil {
+				return nil, fmt.Errorf("could not write to cache file %s: %s", fileName, err)
+			}
+			return resp, nil
+		})
+	}
+}
+
+// fetch asks agg.Fetcher for URL and returns the body as is along with its Content-Type, since feeds and web pages
+// declare their encoding differently. See decodeToUTF8() and decodeHTMLToUTF8().
+// 304 is returned as ErrNotModified and other non-2xx statuses as *StatusError.
+// Cache validators and permanent redirects are recorded in info.
+func (agg *Aggregator) fetch(URL string, info *FeedInfo) (body []byte, contentType string, err error) {
+	resp, err := agg.Fetcher.Fetch(context.Background(), Request{URL: URL, ETag: info.ETag, LastModified: info.LastModified})
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, "", ErrNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", newStatusError(URL, resp)
+	}
+	if resp.StatusCode == http.StatusOK {
+		info.ETag = resp.Header.Get("ETag")
+		info.LastModified = resp.Header.Get("Last-Modified")
+	}
+	if resp.MovedPermanently && resp.URL != "" && resp.URL != URL {
+		info.MovedTo = resp.URL
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
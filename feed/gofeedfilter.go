@@ -2,12 +2,16 @@ package feed
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/atom"
+	"github.com/mmcdole/gofeed/json"
 	"github.com/mmcdole/gofeed/rss"
 )
 
 // CustomRSSTranslator is currently used to instruct mmcdole/gofeed to parse <comments> as item link in Reddit's feed
+// and to keep the <ttl>, <skipHours> and <skipDays> refresh hints which gofeed.Feed has no place for
 type CustomRSSTranslator struct {
 	defaultTranslator *gofeed.DefaultRSSTranslator
 }
@@ -32,32 +36,82 @@ func (ct *CustomRSSTranslator) Translate(feed interface{}) (*gofeed.Feed, error)
 	for i, item := range rss.Items {
 		f.Items[i].Custom = map[string]string{"Comments": item.Comments}
 	}
+	f.Custom = map[string]string{
+		"TTL":       rss.TTL,
+		"SkipHours": strings.Join(rss.SkipHours, ","),
+		"SkipDays":  strings.Join(rss.SkipDays, ","),
+	}
+	return f, nil
+}
+
+// CustomAtomTranslator exposes an entry's <link rel="replies"> (RFC 4685), the Atom equivalent of RSS <comments>,
+// the same way CustomRSSTranslator does
+type CustomAtomTranslator struct {
+	defaultTranslator *gofeed.DefaultAtomTranslator
+}
+
+// NewCustomAtomTranslator creates a new Atom feed translator to be used by our instance of mmcdole/gofeed
+func NewCustomAtomTranslator() *CustomAtomTranslator {
+	t := &CustomAtomTranslator{}
+	t.defaultTranslator = &gofeed.DefaultAtomTranslator{}
+	return t
+}
+
+// Translate is called by mmcdole/gofeed
+func (ct *CustomAtomTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	atom, found := feed.(*atom.Feed)
+	if !found {
+		return nil, fmt.Errorf("Feed did not match expected type of *atom.Feed")
+	}
+	f, err := ct.defaultTranslator.Translate(atom)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range atom.Entries {
+		comments := ""
+		for _, link := range entry.Links {
+			if link.Rel != "replies" {
+				continue
+			}
+			// Prefer an HTML discussion page over a feed of comments
+			if comments == "" || strings.HasPrefix(link.Type, "text/html") {
+				comments = link.Href
+			}
+		}
+		f.Items[i].Custom = map[string]string{"Comments": comments}
+	}
 	return f, nil
 }
 
-// If we ever need an Atom translator here's the skeleton:
-
-// type CustomAtomTranslator struct {
-// 	defaultTranslator *gofeed.DefaultAtomTranslator
-// }
-
-// func NewCustomAtomTranslator() *CustomAtomTranslator {
-// 	t := &CustomAtomTranslator{}
-// 	t.defaultTranslator = &gofeed.DefaultAtomTranslator{}
-// 	return t
-// }
-
-// func (ct *CustomAtomTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
-// 	atom, found := feed.(*atom.Feed)
-// 	if !found {
-// 		return nil, fmt.Errorf("Feed did not match expected type of *atom.Feed")
-// 	}
-// 	f, err := ct.defaultTranslator.Translate(atom)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	for i, item := range atom.Entries {
-// 		f.Items[i].Custom = map[string]string{"Comments": item.Comments}
-// 	}
-// 	return f, nil
-// }
+// CustomJSONTranslator handles JSON Feed link posts: their url is the post itself, which is where discussion happens,
+// while external_url is the article being linked to
+type CustomJSONTranslator struct {
+	defaultTranslator *gofeed.DefaultJSONTranslator
+}
+
+// NewCustomJSONTranslator creates a new JSON Feed translator to be used by our instance of mmcdole/gofeed
+func NewCustomJSONTranslator() *CustomJSONTranslator {
+	t := &CustomJSONTranslator{}
+	t.defaultTranslator = &gofeed.DefaultJSONTranslator{}
+	return t
+}
+
+// Translate is called by mmcdole/gofeed
+func (ct *CustomJSONTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	jsonFeed, found := feed.(*json.Feed)
+	if !found {
+		return nil, fmt.Errorf("Feed did not match expected type of *json.Feed")
+	}
+	f, err := ct.defaultTranslator.Translate(jsonFeed)
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range jsonFeed.Items {
+		f.Items[i].Custom = map[string]string{"Comments": ""}
+		if item.ExternalURL != "" && item.ExternalURL != item.URL {
+			f.Items[i].Link = item.ExternalURL
+			f.Items[i].Custom["Comments"] = item.URL
+		}
+	}
+	return f, nil
+}
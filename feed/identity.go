@@ -0,0 +1,61 @@
+package feed
+
+// isKnown reports whether the item was seen before. Items with a GUID are known by it, so feeds rotating their links
+// don't produce repeats. Their URLs still count as known when seen in another feed or in an item without GUID,
+// but not when the same feed had them under another GUID: that's a feed reusing one URL for a new post.
+func (agg *Aggregator) isKnown(item Item) bool {
+	day := dayOf(agg.now())
+	if item.GUID != "" && agg.known.has(guidKey(item), day) {
+		return true
+	}
+	for _, URL := range []string{item.URL, item.DiscussionURL} {
+		if URL == "" {
+			continue
+		}
+		key := canonicalKey(URL, agg.rules())
+		if !agg.known.has(key, day) {
+			continue
+		}
+		if feed, found := agg.known.guidFeed(key); item.GUID != "" && found && feed == hashKey(item.Feed) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// markKnown records the item's identity so it isn't added again. See isKnown().
+func (agg *Aggregator) markKnown(item Item) {
+	day := dayOf(agg.now())
+	for _, URL := range []string{item.URL, item.DiscussionURL} {
+		if URL == "" {
+			continue
+		}
+		key := canonicalKey(URL, agg.rules())
+		agg.known.add(key, day)
+		if item.GUID != "" {
+			agg.known.setGUIDFeed(key, item.Feed)
+		}
+	}
+	if item.GUID != "" {
+		agg.known.add(guidKey(item), day)
+	}
+}
+
+// guidKey scopes item's GUID to its feed, since GUIDs are only unique within a feed and many are just numbers
+func guidKey(item Item) string {
+	return "guid " + item.Feed + " " + item.GUID
+}
+
+// distrustRepeatedGUIDs clears GUIDs shared by several items of the same feed. Such feeds are identified by URL instead.
+func distrustRepeatedGUIDs(items []Item) {
+	count := make(map[string]int)
+	for _, item := range items {
+		count[item.GUID]++
+	}
+	for i := range items {
+		if count[items[i].GUID] > 1 {
+			items[i].GUID = ""
+		}
+	}
+}
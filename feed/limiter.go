@@ -0,0 +1,139 @@
+package feed
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// hostLimiter serializes requests to the same host and enforces a minimum interval between them.
+// It is safe to use from multiple goroutines, so different hosts can be fetched concurrently.
+type hostLimiter struct {
+	log   *logrus.Logger
+	wait  time.Duration
+	mu    sync.Mutex
+	hosts map[string]*hostSlot
+	// retryAfter holds hosts that asked us to come back later, along with the response that asked it
+	retryAfter map[string]*StatusError
+}
+
+// hostSlot is held by whoever is currently talking to a host. next is only touched while the slot is locked.
+type hostSlot struct {
+	sync.Mutex
+	next time.Time
+}
+
+func newHostLimiter(log *logrus.Logger, wait time.Duration) *hostLimiter {
+	return &hostLimiter{
+		log:        log,
+		wait:       wait,
+		hosts:      make(map[string]*hostSlot),
+		retryAfter: make(map[string]*StatusError),
+	}
+}
+
+// acquire blocks until URL's host is free and its minimum interval has passed.
+// The returned func must be called once the request is done so the next caller can proceed.
+// If the host asked us to retry later, acquire returns a *hostDelayedError right away instead of waiting for hours.
+func (l *hostLimiter) acquire(URL string) (release func(), err error) {
+	slot := l.slot(hostOf(URL))
+	slot.Lock()
+	// Checked once the slot is ours, since whoever had it before might have just been told to come back later
+	if err := l.retryLater(URL); err != nil {
+		slot.Unlock()
+		return nil, err
+	}
+	if wait := time.Until(slot.next); wait > 0 {
+		l.log.Debugf("Waiting %.1f seconds to request from %s", wait.Seconds(), URL)
+		time.Sleep(wait)
+	}
+	return func() {
+		slot.next = time.Now().Add(l.wait)
+		slot.Unlock()
+	}, nil
+}
+
+// delay keeps requests away from URL's host until err.RetryAt
+func (l *hostLimiter) delay(URL string, err *StatusError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.log.Debugf("Delaying requests to %s until %s: %s", hostOf(URL), err.RetryAt.Format(time.RFC3339), err)
+	l.retryAfter[hostOf(URL)] = err
+}
+
+func (l *hostLimiter) retryLater(URL string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	host := hostOf(URL)
+	err, found := l.retryAfter[host]
+	if !found {
+		return nil
+	}
+	if time.Now().After(err.RetryAt) {
+		delete(l.retryAfter, host)
+		return nil
+	}
+	return &hostDelayedError{URL: URL, Cause: err, RetryAt: err.RetryAt}
+}
+
+// hostDelayedError is returned for requests that were never sent because their host, answering another request,
+// asked us to come back later. It's not the requested feed's fault, so it doesn't count as a failure of it.
+type hostDelayedError struct {
+	URL string
+	// Cause is the response that asked to come back later
+	Cause   *StatusError
+	RetryAt time.Time
+}
+
+func (err *hostDelayedError) Error() string {
+	return fmt.Sprintf("not requesting %s until %s since %s", err.URL, err.RetryAt.Format(time.RFC3339), err.Cause)
+}
+
+func (l *hostLimiter) slot(host string) *hostSlot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slot, found := l.hosts[host]
+	if !found {
+		slot = &hostSlot{}
+		l.hosts[host] = slot
+	}
+	return slot
+}
+
+// hostOf returns the lowercased host of URL, or URL itself when it can't be parsed so it still gets its own slot.
+func hostOf(URL string) string {
+	u, err := url.Parse(URL)
+	if err != nil || u.Host == "" {
+		return URL
+	}
+	return strings.ToLower(u.Host)
+}
+
+// interleaveByHost reorders URLs so consecutive entries belong to different hosts whenever possible.
+// Workers pick jobs in order, so this keeps them from queueing up behind the same busy host.
+// Relative order of URLs sharing a host is preserved.
+func interleaveByHost(URLs []string) []string {
+	hosts := make([]string, 0)
+	byHost := make(map[string][]string)
+	for _, URL := range URLs {
+		host := hostOf(URL)
+		if _, found := byHost[host]; !found {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], URL)
+	}
+	interleaved := make([]string, 0, len(URLs))
+	for len(interleaved) < len(URLs) {
+		for _, host := range hosts {
+			if len(byHost[host]) > 0 {
+				interleaved = append(interleaved, byHost[host][0])
+				byHost[host] = byHost[host][1:]
+			}
+		}
+	}
+	return interleaved
+}
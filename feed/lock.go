@@ -0,0 +1,232 @@
+package feed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lockFileName is locked through the operating system by the instance writing to a news directory
+const lockFileName = ".news.lock"
+
+// leaseFileName is where the instance writing to a news directory says who it is, for instances on other machines
+// sharing the directory through Google Drive or Dropbox, which can't see each other's operating system locks
+const leaseFileName = ".news-lease.json"
+
+// leaseRenewInterval is how often the instance holding a lease writes a new heartbeat to it
+const leaseRenewInterval = time.Minute
+
+// leaseTimeout is how long after its last heartbeat a lease is considered stale and can be taken over.
+// It leaves room for sync clients taking a while to bring the lease file over.
+const leaseTimeout = 10 * time.Minute
+
+// LockMode tells NewWithLock() how to share a news directory with other instances
+type LockMode int
+
+const (
+	// Exclusive fails with a *LockedError if another instance holds the directory
+	Exclusive LockMode = iota
+	// TakeOver is like Exclusive but takes over stale leases of instances on other machines, such as one that crashed
+	TakeOver
+	// ReadOnly doesn't lock the directory and never writes to it, see Aggregator.ReadOnly
+	ReadOnly
+)
+
+// Lease tells which instance writes to a news directory
+type Lease struct {
+	Host      string
+	PID       int
+	Heartbeat time.Time
+}
+
+func (lease Lease) String() string {
+	return fmt.Sprintf("news (PID %d) on %s, last seen %s ago", lease.PID, lease.Host, time.Since(lease.Heartbeat).Round(time.Second))
+}
+
+func (lease Lease) stale() bool {
+	return time.Since(lease.Heartbeat) > leaseTimeout
+}
+
+// ErrLeaseLost is returned by updates once another instance took the news directory over, such as after this machine
+// slept past leaseTimeout. Nothing is written to the directory from then on.
+var ErrLeaseLost = errors.New("taken over by another instance")
+
+// LockedError is returned when another instance holds a news directory.
+// Lease is zero if the other instance runs on this machine and hasn't written its lease yet.
+type LockedError struct {
+	Dir   string
+	Lease Lease
+}
+
+func (e *LockedError) Error() string {
+	if e.Lease.Host == "" {
+		return fmt.Sprintf("%s is in use by another news instance on this machine", e.Dir)
+	}
+	if e.Lease.stale() {
+		return fmt.Sprintf("%s is in use by %s. If it's no longer running, take over with -takeover", e.Dir, e.Lease)
+	}
+	return fmt.Sprintf("%s is in use by %s. Use -readonly to run alongside it", e.Dir, e.Lease)
+}
+
+// dirLock is this process' hold on a news directory. It's shared by Aggregators of the same directory,
+// which can't run into each other since they are in the same process.
+type dirLock struct {
+	dir   string
+	file  *os.File
+	lease Lease
+	users int
+	// lost is set when another instance took the lease over, such as after this machine slept past leaseTimeout
+	lost atomic.Bool
+	stop chan struct{}
+	done chan struct{}
+	log  *logrus.Logger
+}
+
+var (
+	dirLocksMu sync.Mutex
+	dirLocks   = make(map[string]*dirLock)
+)
+
+// acquireDirLock locks dir through the operating system and writes a lease to it which is renewed until release()
+func acquireDirLock(log *logrus.Logger, dir string, mode LockMode) (*dirLock, error) {
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	dirLocksMu.Lock()
+	defer dirLocksMu.Unlock()
+	if lock, found := dirLocks[key]; found {
+		lock.users++
+		return lock, nil
+	}
+	file, err := lockFile(filepath.Join(dir, lockFileName))
+	if errors.Is(err, errLocked) {
+		lease, _ := readLease(dir)
+		return nil, &LockedError{Dir: dir, Lease: lease}
+	} else if err != nil {
+		return nil, fmt.Errorf("could not lock %s: %s", dir, err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	// A lease left by this machine was necessarily from an instance that's gone, since it would hold the lock otherwise
+	lease, err := readLease(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("ignoring unreadable lease %s: %s", filepath.Join(dir, leaseFileName), err)
+	} else if err == nil && lease.Host != host && (!lease.stale() || mode != TakeOver) {
+		unlockFile(file)
+		return nil, &LockedError{Dir: dir, Lease: lease}
+	} else if err == nil && lease.Host != host {
+		log.Warnf("taking over %s from %s", dir, lease)
+	}
+	lock := &dirLock{
+		dir:   dir,
+		file:  file,
+		lease: Lease{Host: host, PID: os.Getpid()},
+		users: 1,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		log:   log,
+	}
+	if err := lock.renew(); err != nil {
+		unlockFile(file)
+		return nil, fmt.Errorf("could not write lease to %s: %s", dir, err)
+	}
+	go lock.heartbeat()
+	dirLocks[key] = lock
+	return lock, nil
+}
+
+// heartbeat renews the lease until release() is called, or until another instance takes it over
+func (lock *dirLock) heartbeat() {
+	defer close(lock.done)
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+		}
+		if lock.check() != nil {
+			return
+		}
+		if err := lock.renew(); err != nil {
+			lock.log.Errorf("could not renew lease of %s: %s", lock.dir, err)
+		}
+	}
+}
+
+// check reads the lease again, returning ErrLeaseLost if another instance took it over. It's called before every
+// write since heartbeats are a minute apart and a machine waking up from sleep may write before the next one.
+func (lock *dirLock) check() error {
+	if lock.lost.Load() {
+		return fmt.Errorf("%s was %w", lock.dir, ErrLeaseLost)
+	}
+	if lease, err := readLease(lock.dir); err == nil && (lease.Host != lock.lease.Host || lease.PID != lock.lease.PID) {
+		lock.log.Errorf("%s was taken over by %s. Stopped writing to it", lock.dir, lease)
+		lock.lost.Store(true)
+		return fmt.Errorf("%s was %w", lock.dir, ErrLeaseLost)
+	}
+	return nil
+}
+
+func (lock *dirLock) renew() error {
+	lock.lease.Heartbeat = time.Now().UTC()
+	return writeFileAtomically(filepath.Join(lock.dir, leaseFileName), 0, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "\t")
+		return encoder.Encode(lock.lease)
+	})
+}
+
+// release gives up the lock once every Aggregator sharing it is done, removing the lease unless it was taken over
+func (lock *dirLock) release() {
+	dirLocksMu.Lock()
+	defer dirLocksMu.Unlock()
+	if lock.users--; lock.users > 0 {
+		return
+	}
+	close(lock.stop)
+	<-lock.done
+	if !lock.lost.Load() {
+		os.Remove(filepath.Join(lock.dir, leaseFileName))
+	}
+	unlockFile(lock.file)
+	key, _ := filepath.Abs(lock.dir)
+	delete(dirLocks, key)
+}
+
+func readLease(dir string) (Lease, error) {
+	lease := Lease{}
+	content, err := os.ReadFile(filepath.Join(dir, leaseFileName))
+	if err != nil {
+		return lease, err
+	}
+	return lease, json.Unmarshal(content, &lease)
+}
+
+// checkLease returns ErrLeaseLost if the news directory was taken over by another instance, see dirLock.check()
+func (agg *Aggregator) checkLease() error {
+	if agg.lock == nil {
+		return nil
+	}
+	return agg.lock.check()
+}
+
+// Close releases the lock on the news directory. The Aggregator must not be used afterwards.
+func (agg *Aggregator) Close() {
+	if agg.lock != nil {
+		agg.lock.release()
+		agg.lock = nil
+	}
+}
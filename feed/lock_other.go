@@ -0,0 +1,20 @@
+//go:build !unix && !windows
+
+package feed
+
+import (
+	"errors"
+	"os"
+)
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+// lockFile only opens fileName since this system has no file locks. Only instances on other machines are kept apart, by leases.
+func lockFile(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+func unlockFile(f *os.File) {
+	f.Close()
+}
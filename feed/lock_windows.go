@@ -0,0 +1,34 @@
+package feed
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+// errorSharingViolation is what Windows answers when opening a file someone else opened without sharing it
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile opens fileName without sharing it, creating it if needed, so nobody else can open it until it's closed.
+// The lock goes away with the process.
+func lockFile(fileName string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(fileName)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if errors.Is(err, errorSharingViolation) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return os.NewFile(uintptr(handle), fileName), nil
+}
+
+func unlockFile(f *os.File) {
+	f.Close()
+}
@@ -1,20 +1,13 @@
 package feed
 
 import (
-	"fmt"
 	"html"
 	"io"
-	"io/ioutil"
 	"math/rand"
-	"net/http"
-	"net/url"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"time"
-	"unicode"
-
-	"github.com/sirupsen/logrus"
 
 	"github.com/kennygrant/sanitize"
 )
@@ -51,35 +44,17 @@ func fileExists(f string) bool {
 	return !os.IsNotExist(err)
 }
 
-func makeURLDebouncer(log *logrus.Logger, wait time.Duration) func(URL string) string {
-	lastAccessed := make(map[string]time.Time)
-	return func(URL string) string {
-		u, err := url.Parse(URL)
-		if err != nil {
-			log.Errorf("Could not parse URL %s, will try to fetch it anyway: %s", URL, err)
-			return URL
-		}
-		domain := u.Host
-		timePassed := time.Since(lastAccessed[domain])
-		if timePassed < wait {
-			log.Debugf("Waiting %.1f seconds to request from %s", (wait - timePassed).Seconds(), URL)
-			time.Sleep(wait - timePassed)
-		}
-		lastAccessed[domain] = time.Now()
-		return URL
-	}
-}
-
+// cleanXML removes characters that aren't allowed in XML 1.0, such as stray control characters, which make parsers give up.
+// XML must already be UTF-8, see decodeToUTF8().
 func cleanXML(XML []byte) []byte {
 	// http://blog.zikes.me/post/cleaning-xml-files-before-unmarshaling-in-go/
-	// Remove utf8 special shenanigans
-	printOnly := func(r rune) rune {
-		if unicode.IsPrint(r) {
+	xmlCharsOnly := func(r rune) rune {
+		if isXMLChar(r) {
 			return r
 		}
 		return -1
 	}
-	return []byte(strings.Map(printOnly, string(XML)))
+	return []byte(strings.Map(xmlCharsOnly, string(XML)))
 }
 
 // Fixes "could not parse HTML: XML syntax error on line 1: invalid character entity &mdash;" in codes like this:
@@ -89,36 +64,39 @@ func unescapeXML(XML string) string {
 	return html.UnescapeString(XML)
 }
 
-// makeCachedURLFetcher is retired. It was used during initial phases of development to prevent spamming feed sources.
-func makeCachedURLFetcher(log *logrus.Logger, minDomainRequestInterval time.Duration, client *http.Client, cacheDir string) func(URL string) (content []byte, err error) {
-	fetcher := MakeURLFetcher(log, minDomainRequestInterval, client)
-	return func(URL string) (content []byte, err error) {
-		cacheDir = filepath.Clean(cacheDir)
-		fileName := cacheDir + "/" + sanitize.BaseName(URL) + ".html"
-		if fileExists(fileName) {
-			log.Debugf("Cached %s", fileName)
-			b, err := ioutil.ReadFile(fileName)
-			if err != nil {
-				return []byte(""), fmt.Errorf("error opening cache %s : %s", URL, err)
-			}
-			return b, nil
-		}
-		log.Debugf("Web %s", URL)
-		content, err = fetcher(URL)
-		if err != nil {
-			return content, err
-		}
+// maxSummaryLength is how many characters of an item's description are kept as its summary
+const maxSummaryLength = 300
 
-		f, err := os.Create(fileName)
-		if err != nil {
-			return nil, fmt.Errorf("could not open cache file file %s for writing: %s", fileName, err)
-		}
-		defer f.Close()
-		if _, err = f.Write(content); err != nil {
-			return []byte(""), fmt.Errorf("could not write to cache file %s: %s", fileName, err)
+// summarize turns an item description, which is often HTML, into a short single line of plain text
+func summarize(description string) string {
+	summary := strings.Join(strings.Fields(html.UnescapeString(sanitize.HTML(description))), " ")
+	if runes := []rune(summary); len(runes) > maxSummaryLength {
+		summary = strings.TrimSpace(string(runes[:maxSummaryLength-1])) + "…"
+	}
+	return summary
+}
+
+// sortByDate sorts items from newest to oldest by published date, falling back to when we first saw them.
+// Published dates later than first seen, such as those from feeds with a wrong clock, aren't trusted.
+func sortByDate(items []Item) {
+	date := func(item Item) time.Time {
+		if !item.PublishedAt.IsZero() && item.PublishedAt.Before(item.FirstSeen) {
+			return item.PublishedAt
 		}
-		return content, nil
+		return item.FirstSeen
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return date(items[i]).After(date(items[j]))
+	})
+}
+
+func sortedMapKeys(srcMap map[string]string) (mapKeys []string) {
+	mapKeys = make([]string, 0, len(srcMap))
+	for k := range srcMap {
+		mapKeys = append(mapKeys, k)
 	}
+	sort.Strings(mapKeys)
+	return mapKeys
 }
 
 func shuffleMapKeys(srcMap map[string]string) (mapKeys []string) {
@@ -0,0 +1,163 @@
+package feed
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennygrant/sanitize"
+	"github.com/sirupsen/logrus"
+)
+
+// recordedResponse is how Record stores a Response in <name>.json. The body goes to <name>.body untouched,
+// so feeds can be read or edited by hand when reproducing a bug.
+type recordedResponse struct {
+	URL              string
+	FinalURL         string
+	MovedPermanently bool `json:",omitempty"`
+	StatusCode       int
+	Header           http.Header
+	FetchedAt        time.Time
+}
+
+// Record saves every response to dir, overwriting earlier responses for the same URL. Failed requests aren't recorded.
+// Replay serves them back. Along with a copy of index.html from before the update, which the -record flag takes care of,
+// this captures an update cycle so it can be reproduced without network.
+func Record(log *logrus.Logger, dir string) Middleware {
+	var mu sync.Mutex
+	return func(next Fetcher) Fetcher {
+		return FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+			fetchedAt := time.Now()
+			resp, err := next.Fetch(ctx, req)
+			if err != nil {
+				return resp, err
+			}
+			recorded, err := json.MarshalIndent(recordedResponse{
+				URL:              req.URL,
+				FinalURL:         resp.URL,
+				MovedPermanently: resp.MovedPermanently,
+				StatusCode:       resp.StatusCode,
+				Header:           resp.Header,
+				FetchedAt:        fetchedAt.UTC(),
+			}, "", "\t")
+			if err != nil {
+				return nil, fmt.Errorf("could not record response of %s: %s", req.URL, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			name := filepath.Join(dir, recordingName(req.URL))
+			if err := os.WriteFile(name+".body", resp.Body, 0644); err != nil {
+				return nil, fmt.Errorf("could not record response of %s: %s", req.URL, err)
+			}
+			if err := os.WriteFile(name+".json", recorded, 0644); err != nil {
+				return nil, fmt.Errorf("could not record response of %s: %s", req.URL, err)
+			}
+			log.Debugf("Recorded %s to %s", req.URL, name)
+			return resp, nil
+		})
+	}
+}
+
+// Replay is a Fetcher serving the responses saved by Record in dir. URLs that weren't recorded fail.
+// Responses are read once, so replaying gives the same result however many times a URL is asked for.
+func Replay(dir string) (Fetcher, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	responses := make(map[string]*Response)
+	for _, file := range files {
+		recorded := recordedResponse{}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read recording %s: %s", file, err)
+		}
+		if err := json.Unmarshal(content, &recorded); err != nil {
+			return nil, fmt.Errorf("could not parse recording %s: %s", file, err)
+		}
+		body, err := os.ReadFile(strings.TrimSuffix(file, ".json") + ".body")
+		if err != nil {
+			return nil, fmt.Errorf("could not read recording %s: %s", file, err)
+		}
+		responses[recorded.URL] = &Response{
+			URL:              recorded.FinalURL,
+			MovedPermanently: recorded.MovedPermanently,
+			StatusCode:       recorded.StatusCode,
+			Header:           recorded.Header,
+			Body:             body,
+		}
+	}
+	return FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+		resp, found := responses[req.URL]
+		if !found {
+			return nil, fmt.Errorf("%s was not recorded", req.URL)
+		}
+		// Copy so callers can't alter what later replays get
+		replayed := *resp
+		replayed.Body = append([]byte(nil), resp.Body...)
+		replayed.Header = resp.Header.Clone()
+		return &replayed, nil
+	}), nil
+}
+
+// RecordedAt returns when the first response in dir was fetched. Replayed updates use it as their clock
+// so they produce the same index.html as the recorded update. Returns zero time if nothing was recorded.
+func RecordedAt(dir string) (time.Time, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	first := time.Time{}
+	for _, file := range files {
+		recorded := recordedResponse{}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("could not read recording %s: %s", file, err)
+		}
+		if err := json.Unmarshal(content, &recorded); err != nil {
+			return time.Time{}, fmt.Errorf("could not parse recording %s: %s", file, err)
+		}
+		if first.IsZero() || recorded.FetchedAt.Before(first) {
+			first = recorded.FetchedAt
+		}
+	}
+	return first, nil
+}
+
+// LoadRecordedIndex replaces index.html of agg.Directory with the one recorded in dir along with the responses,
+// so the recorded update can be replayed. It's meant for a directory just created for the replay, since the
+// replaced index.html isn't backed up.
+func (agg *Aggregator) LoadRecordedIndex(dir string) error {
+	if agg.ReadOnly {
+		return fmt.Errorf("%s is open read-only", agg.Directory)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(filepath.Join(agg.Directory, "index.html"), 0, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return agg.loadFeedsAndItemsFromHTMLFiles()
+}
+
+// recordingName turns URL into a readable file name, made unique by a hash of the full URL
+func recordingName(URL string) string {
+	name := sanitize.BaseName(URL)
+	if len(name) > 60 {
+		name = name[:60]
+	}
+	return fmt.Sprintf("%s-%x", name, sha1.Sum([]byte(URL)))[:len(name)+9]
+}
@@ -0,0 +1,58 @@
+package feed
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// recoverIndex rebuilds a missing, unreadable or emptied index.html so a bad sync or a crash doesn't stop the aggregator.
+// The newest backup with feeds in it is restored, see writeFileAtomically(). Failing that, feeds are taken from the
+// newest pageN.html, since every page carries the feed list too, and index.html starts without news.
+// The broken index.html is kept as index.html.corrupt. Returns problem along with the reason if nothing could be restored.
+func (agg *Aggregator) recoverIndex(indexFile string, problem error) (items []Item, feeds map[string]string, feedInfos map[string]*FeedInfo, err error) {
+	candidates := make([]string, 0)
+	for n := 1; n <= pageBackups; n++ {
+		candidates = append(candidates, backupName(indexFile, n))
+	}
+	pages := make([]string, 0)
+	for i := 2; fileExists(filepath.Clean(fmt.Sprintf(agg.Directory+"/page%d.html", i))); i++ {
+		pages = append([]string{filepath.Clean(fmt.Sprintf(agg.Directory+"/page%d.html", i))}, pages...)
+	}
+	candidates = append(candidates, pages...)
+	for i, candidate := range candidates {
+		if !fileExists(candidate) {
+			continue
+		}
+		items, feeds, feedInfos, err = loadFromFile(candidate)
+		if err != nil || len(feeds) == 0 {
+			agg.log.Debugf("could not restore %s from %s: no feeds found", indexFile, candidate)
+			continue
+		}
+		if i >= pageBackups {
+			// Pages only have older news, which are already there
+			items = make([]Item, 0)
+		}
+		if fileExists(indexFile) {
+			// Moving it away also keeps the broken file out of the backups
+			if err := os.Rename(indexFile, indexFile+".corrupt"); err != nil {
+				return nil, nil, nil, fmt.Errorf("%s and it could not be moved away to restore it: %s", problem, err)
+			}
+		}
+		agg.pages = len(pages) + 1
+		if err := agg.saveIndex(indexFile, items, feeds, feedInfos); err != nil {
+			return nil, nil, nil, fmt.Errorf("%s and it could not be restored from %s: %s", problem, candidate, err)
+		}
+		agg.log.Warnf("%s. Restored %d feeds and %d news from %s. The broken file, if any, was kept as %s.corrupt",
+			problem, len(feeds), len(items), candidate, indexFile)
+		// Forget news that only the broken file knew about so they are fetched again
+		if err := os.Remove(filepath.Join(agg.Directory, seenIndexFileName)); err != nil && !os.IsNotExist(err) {
+			return nil, nil, nil, fmt.Errorf("%s and the seen news could not be reset: %s", problem, err)
+		}
+		if err := agg.loadFeedsAndItemsFromHTMLFiles(); err != nil {
+			return nil, nil, nil, err
+		}
+		return items, feeds, feedInfos, nil
+	}
+	return nil, nil, nil, fmt.Errorf("%s and there's no backup or pageN.html to restore feeds from", problem)
+}
@@ -0,0 +1,191 @@
+package feed
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+)
+
+// RefreshHints are what a publisher says about how often its feed should be polled
+type RefreshHints struct {
+	// TTL comes from RSS <ttl> or the syndication module's sy:updatePeriod and sy:updateFrequency
+	TTL time.Duration
+	// SkipHours (0-23, GMT) and SkipDays come from RSS <skipHours> and <skipDays>
+	SkipHours []int
+	SkipDays  []time.Weekday
+}
+
+// refreshHintsFromFeed collects the refresh hints left in feed.Custom by CustomRSSTranslator and in the sy extension
+func refreshHintsFromFeed(feed *gofeed.Feed) (hints RefreshHints) {
+	if minutes, err := strconv.Atoi(strings.TrimSpace(feed.Custom["TTL"])); err == nil && minutes > 0 {
+		hints.TTL = time.Duration(minutes) * time.Minute
+	}
+	if sy, found := feed.Extensions["sy"]; found && hints.TTL == 0 {
+		hints.TTL = syndicationPeriod(firstExtensionValue(sy["updatePeriod"]), firstExtensionValue(sy["updateFrequency"]))
+	}
+	hints.SkipHours = parseSkipHours(feed.Custom["SkipHours"])
+	hints.SkipDays = parseSkipDays(feed.Custom["SkipDays"])
+	return hints
+}
+
+// syndicationPeriod turns sy:updatePeriod (hourly, daily, weekly, monthly or yearly) and sy:updateFrequency
+// (how many times per period, 1 by default) into a polling interval. Returns zero if period is unknown.
+func syndicationPeriod(period string, frequency string) time.Duration {
+	periods := map[string]time.Duration{
+		"hourly":  time.Hour,
+		"daily":   24 * time.Hour,
+		"weekly":  7 * 24 * time.Hour,
+		"monthly": 30 * 24 * time.Hour,
+		"yearly":  365 * 24 * time.Hour,
+	}
+	duration := periods[strings.ToLower(strings.TrimSpace(period))]
+	if times, err := strconv.Atoi(strings.TrimSpace(frequency)); err == nil && times > 1 {
+		duration /= time.Duration(times)
+	}
+	return duration
+}
+
+func firstExtensionValue(extensions []ext.Extension) string {
+	if len(extensions) == 0 {
+		return ""
+	}
+	return extensions[0].Value
+}
+
+// parseSkipHours reads a comma separated list of hours such as "0,1,2". Invalid hours are ignored.
+func parseSkipHours(list string) (hours []int) {
+	for _, field := range strings.Split(list, ",") {
+		if hour, err := strconv.Atoi(strings.TrimSpace(field)); err == nil && hour >= 0 && hour <= 23 {
+			hours = append(hours, hour)
+		}
+	}
+	return hours
+}
+
+// parseSkipDays reads a comma separated list of day names such as "Saturday,Sunday". Invalid days are ignored.
+func parseSkipDays(list string) (days []time.Weekday) {
+	for _, field := range strings.Split(list, ",") {
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if strings.EqualFold(strings.TrimSpace(field), day.String()) {
+				days = append(days, day)
+			}
+		}
+	}
+	return days
+}
+
+// nextFetch returns when a feed fetched at now should be fetched again. The interval is the feed's TTL if it has one,
+// fallback otherwise, bounded by min and max. The result is then pushed past any skipped hour or day.
+func (hints RefreshHints) nextFetch(now time.Time, fallback, min, max time.Duration) time.Time {
+	interval := fallback
+	if hints.TTL > 0 {
+		interval = hints.TTL
+	}
+	if interval < min {
+		interval = min
+	}
+	if max > 0 && interval > max {
+		interval = max
+	}
+	return hints.skipForward(now.Add(interval))
+}
+
+// skipForward pushes t past any hour or day the publisher asked not to be polled at
+func (hints RefreshHints) skipForward(t time.Time) time.Time {
+	// A week of hours is enough to get past any combination of skipped hours and days, unless everything is skipped
+	for i := 0; i < 7*24 && hints.skips(t); i++ {
+		t = t.UTC().Truncate(time.Hour).Add(time.Hour)
+	}
+	return t
+}
+
+// skips reports whether the publisher asked not to be polled at t
+func (hints RefreshHints) skips(t time.Time) bool {
+	t = t.UTC()
+	for _, hour := range hints.SkipHours {
+		if t.Hour() == hour {
+			return true
+		}
+	}
+	for _, day := range hints.SkipDays {
+		if t.Weekday() == day {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleNextFetch sets NextFetch using the feed's own interval when the user set one in index.html,
+// or its refresh hints otherwise. See RefreshHints.nextFetch for fallback, min and max.
+func (info *FeedInfo) scheduleNextFetch(from time.Time, fallback, min, max time.Duration) {
+	if info.Interval > 0 {
+		info.NextFetch = info.Hints.skipForward(from.Add(info.Interval))
+		return
+	}
+	info.NextFetch = info.Hints.nextFetch(from, fallback, min, max)
+}
+
+// dueAt returns when the feed may be fetched next, considering both its schedule and failure backoff.
+// Zero time means right away.
+func (info *FeedInfo) dueAt() time.Time {
+	if info.RetryAt.After(info.NextFetch) {
+		return info.RetryAt
+	}
+	return info.NextFetch
+}
+
+// NextDue returns when the next feed will be due. Disabled feeds are not considered.
+// Returns now if a feed is due already and zero time if there are no enabled feeds at all.
+func (agg *Aggregator) NextDue() time.Time {
+	now := agg.now()
+	next := time.Time{}
+	for feedURL := range agg.Feeds {
+		info := agg.FeedInfos[feedURL]
+		if info == nil {
+			return now
+		}
+		if info.Disabled {
+			continue
+		}
+		due := info.dueAt()
+		if !due.After(now) {
+			return now
+		}
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
+
+// Run calls Update every time a feed is due until stop is closed. Failed updates, such as when index.html is
+// broken beyond repair, are logged and tried again later so news keeps running until things are fixed.
+// The exception is ErrLeaseLost, which Run returns since updates can't succeed once the directory was taken over.
+// It sleeps at least a minute and at most DefaultInterval between updates,
+// so feeds added to index.html by hand are picked up without a restart.
+func (agg *Aggregator) Run(stop <-chan struct{}) error {
+	for {
+		if err := agg.Update(); errors.Is(err, ErrLeaseLost) {
+			return err
+		} else if err != nil {
+			agg.log.Errorf("Update failed, trying again later: %s", err)
+		}
+		wait := time.Until(agg.NextDue())
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+		if agg.DefaultInterval > time.Minute && wait > agg.DefaultInterval {
+			wait = agg.DefaultInterval
+		}
+		agg.log.Infof("Done. Waiting %s for next update...", wait.Round(time.Second))
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
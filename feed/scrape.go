@@ -0,0 +1,112 @@
+package feed
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/kennygrant/sanitize"
+)
+
+// ScrapeSelectors turn a web page without a feed into a feed source. They are CSS selectors set by users
+// as data-scrape-* attributes on the page's .feed anchor in index.html, for example:
+// <a class="feed" href="https://example.com/news" data-scrape-item="article" data-scrape-title="h2" data-scrape-link="h2 a" data-scrape-date="time">Example</a>
+type ScrapeSelectors struct {
+	// Item matches one element per news item. Title, Link and Date are relative to it.
+	Item string
+	// Title defaults to the text of the link
+	Title string
+	// Link defaults to the item itself if it's a link, or the first link inside it otherwise
+	Link string
+	// Date is optional. Its datetime attribute is used if present, its text otherwise.
+	Date string
+}
+
+// scrapeDateLayouts are the date formats tried on scraped dates, on top of the datetime attribute's RFC 3339
+var scrapeDateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"2 January 2006",
+	"02 Jan 2006",
+}
+
+// scrapeHTML extracts items from a web page using selectors. Like parseXML, items are returned from oldest to newest,
+// assuming the page lists the newest first.
+func (agg *Aggregator) scrapeHTML(page []byte, pageURL string, selectors *ScrapeSelectors) (items []Item, err error) {
+	items = make([]Item, 0)
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return items, fmt.Errorf("could not parse page URL: %s", err)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(page))
+	if err != nil {
+		return items, fmt.Errorf("could not parse HTML: %s", err)
+	}
+	matches := doc.Find(selectors.Item)
+	if matches.Length() == 0 {
+		return items, fmt.Errorf("no items matched selector %q", selectors.Item)
+	}
+	matches.Each(func(i int, s *goquery.Selection) {
+		link := s
+		if selectors.Link != "" {
+			link = s.Find(selectors.Link).First()
+		} else if !s.Is("a[href]") {
+			link = s.Find("a[href]").First()
+		}
+		href, err := base.Parse(strings.TrimSpace(link.AttrOr("href", "")))
+		if err != nil || link.AttrOr("href", "") == "" {
+			agg.log.Debugf("skipping item %d scraped from %s due to lack of URL", i, pageURL)
+			return
+		}
+		title := strings.Join(strings.Fields(link.Text()), " ")
+		if selectors.Title != "" {
+			title = strings.Join(strings.Fields(s.Find(selectors.Title).First().Text()), " ")
+		}
+		if title == "" {
+			title = sanitize.Name(href.String())
+		}
+		newItem := Item{
+			Title: title,
+			URL:   href.String(),
+		}
+		if selectors.Date != "" {
+			date := s.Find(selectors.Date).First()
+			newItem.PublishedAt = parseScrapedDate(date.AttrOr("datetime", strings.TrimSpace(date.Text())))
+		}
+		items = append([]Item{newItem}, items...)
+	})
+	return items, nil
+}
+
+// parseScrapedDate tries scrapeDateLayouts on s, returning zero time if none fits
+func parseScrapedDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range scrapeDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// scrapeSelectorsFromAnchor reads the data-scrape-* attributes of a .feed anchor. Returns nil for regular feeds.
+func scrapeSelectorsFromAnchor(s *goquery.Selection) *ScrapeSelectors {
+	item := strings.TrimSpace(s.AttrOr("data-scrape-item", ""))
+	if item == "" {
+		return nil
+	}
+	return &ScrapeSelectors{
+		Item:  item,
+		Title: strings.TrimSpace(s.AttrOr("data-scrape-title", "")),
+		Link:  strings.TrimSpace(s.AttrOr("data-scrape-link", "")),
+		Date:  strings.TrimSpace(s.AttrOr("data-scrape-date", "")),
+	}
+}
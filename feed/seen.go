@@ -0,0 +1,247 @@
+package feed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// seenIndexFileName keeps the identities of every item ever added to a news directory, so starting up doesn't
+// mean parsing every pageN.html. See seenIndex.
+const seenIndexFileName = ".news-seen"
+
+// seenIndexMagic starts seen index files, followed by their format version
+const seenIndexMagic = "NEWSSEEN"
+
+const seenIndexVersion = 1
+
+// seenIndex remembers the identities of items, canonical URLs and guidKey()s, as 64-bit hashes along with the day
+// they were last seen, which takes a fraction of the memory of the keys themselves. See isKnown().
+// It's saved to seenIndexFileName after every update. pageN.html files never change once written, so as long as the
+// file covers all of them only index.html needs to be read on startup.
+type seenIndex struct {
+	// days maps hashes of identities to the day they were last seen, counted from the Unix epoch
+	days map[uint64]uint32
+	// guidFeeds maps hashes of canonical URLs of items with GUIDs to the hash of the feed of the last such item
+	guidFeeds map[uint64]uint64
+	// pages is how many html files, index.html included, the index covers
+	pages int
+	// rules is the hash of the URL rules canonical URLs were made with, see SetURLRules()
+	rules uint64
+	// dirty is set when the index changed since it was loaded or saved
+	dirty bool
+}
+
+func newSeenIndex() *seenIndex {
+	return &seenIndex{days: make(map[uint64]uint32), guidFeeds: make(map[uint64]uint64)}
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func dayOf(t time.Time) uint32 {
+	return uint32(t.Unix() / int64(24*time.Hour/time.Second))
+}
+
+// has reports whether key was seen. Looking it up counts as seeing it on day, so identities still listed by feeds
+// don't expire.
+func (index *seenIndex) has(key string, day uint32) bool {
+	hash := hashKey(key)
+	last, found := index.days[hash]
+	if found && last < day {
+		index.days[hash] = day
+		index.dirty = true
+	}
+	return found
+}
+
+func (index *seenIndex) add(key string, day uint32) {
+	hash := hashKey(key)
+	if last, found := index.days[hash]; !found || last < day {
+		index.days[hash] = day
+		index.dirty = true
+	}
+}
+
+// guidFeed returns the hash of the feed of the last item with a GUID seen at URL key, if any
+func (index *seenIndex) guidFeed(key string) (uint64, bool) {
+	feed, found := index.guidFeeds[hashKey(key)]
+	return feed, found
+}
+
+func (index *seenIndex) setGUIDFeed(key string, feed string) {
+	hash, feedHash := hashKey(key), hashKey(feed)
+	if index.guidFeeds[hash] != feedHash {
+		index.guidFeeds[hash] = feedHash
+		index.dirty = true
+	}
+}
+
+// forget drops identities last seen before day
+func (index *seenIndex) forget(day uint32) int {
+	forgotten := 0
+	for hash, last := range index.days {
+		if last < day {
+			delete(index.days, hash)
+			delete(index.guidFeeds, hash)
+			forgotten++
+		}
+	}
+	if forgotten > 0 {
+		index.dirty = true
+	}
+	return forgotten
+}
+
+// writeTo saves the index: magic, version, pages, rules hash, then both maps as counts followed by their entries
+func (index *seenIndex) writeTo(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString(seenIndexMagic)
+	for _, value := range []interface{}{uint32(seenIndexVersion), uint32(index.pages), index.rules, uint32(len(index.days))} {
+		binary.Write(buf, binary.LittleEndian, value)
+	}
+	// Sorted so the same index always makes the same file, which sync clients appreciate
+	hashes := make([]uint64, 0, len(index.days))
+	for hash := range index.days {
+		hashes = append(hashes, hash)
+	}
+	for _, hash := range sortHashes(hashes) {
+		binary.Write(buf, binary.LittleEndian, hash)
+		binary.Write(buf, binary.LittleEndian, index.days[hash])
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(index.guidFeeds)))
+	hashes = hashes[:0]
+	for hash := range index.guidFeeds {
+		hashes = append(hashes, hash)
+	}
+	for _, hash := range sortHashes(hashes) {
+		binary.Write(buf, binary.LittleEndian, hash)
+		binary.Write(buf, binary.LittleEndian, index.guidFeeds[hash])
+	}
+	return buf.Flush()
+}
+
+func readSeenIndex(r io.Reader) (*seenIndex, error) {
+	buf := bufio.NewReader(r)
+	magic := make([]byte, len(seenIndexMagic))
+	if _, err := io.ReadFull(buf, magic); err != nil || string(magic) != seenIndexMagic {
+		return nil, errors.New("not a seen index")
+	}
+	var version, pages, count uint32
+	index := newSeenIndex()
+	for _, value := range []interface{}{&version, &pages, &index.rules, &count} {
+		if err := binary.Read(buf, binary.LittleEndian, value); err != nil {
+			return nil, fmt.Errorf("truncated header: %s", err)
+		}
+	}
+	if version != seenIndexVersion {
+		return nil, fmt.Errorf("unknown version %d", version)
+	}
+	index.pages = int(pages)
+	for i := uint32(0); i < count; i++ {
+		var hash uint64
+		var day uint32
+		if err := binary.Read(buf, binary.LittleEndian, &hash); err != nil {
+			return nil, fmt.Errorf("truncated: %s", err)
+		}
+		if err := binary.Read(buf, binary.LittleEndian, &day); err != nil {
+			return nil, fmt.Errorf("truncated: %s", err)
+		}
+		index.days[hash] = day
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("truncated: %s", err)
+	}
+	for i := uint32(0); i < count; i++ {
+		var hash, feed uint64
+		if err := binary.Read(buf, binary.LittleEndian, &hash); err != nil {
+			return nil, fmt.Errorf("truncated: %s", err)
+		}
+		if err := binary.Read(buf, binary.LittleEndian, &feed); err != nil {
+			return nil, fmt.Errorf("truncated: %s", err)
+		}
+		index.guidFeeds[hash] = feed
+	}
+	return index, nil
+}
+
+func sortHashes(hashes []uint64) []uint64 {
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	return hashes
+}
+
+// rulesHash identifies the URL rules in use, since canonical URLs and so the index depend on them
+func (agg *Aggregator) rulesHash() uint64 {
+	rules := agg.rules()
+	lines := make([]string, 0, len(rules))
+	for domain, rule := range rules {
+		lines = append(lines, domain+" keep="+strings.Join(rule.KeepParams, ",")+" strip="+strings.Join(rule.StripParams, ","))
+	}
+	sort.Strings(lines)
+	return hashKey(strings.Join(lines, "\n"))
+}
+
+// loadSeenIndex reads the seen index of agg.Directory, returning nil if it's missing or doesn't cover the given number
+// of html files under the current URL rules, in which case it has to be rebuilt from them
+func (agg *Aggregator) loadSeenIndex(pages int) *seenIndex {
+	fileName := filepath.Join(agg.Directory, seenIndexFileName)
+	f, err := os.Open(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			agg.log.Warnf("could not open %s, rebuilding it: %s", fileName, err)
+		}
+		return nil
+	}
+	defer f.Close()
+	index, err := readSeenIndex(f)
+	if err != nil {
+		agg.log.Warnf("could not read %s, rebuilding it: %s", fileName, err)
+		return nil
+	}
+	if index.pages != pages || index.rules != agg.rulesHash() {
+		agg.log.Infof("%s is out of date, rebuilding it", fileName)
+		return nil
+	}
+	return index
+}
+
+// saveSeenIndex writes the seen index if it changed, first forgetting identities not seen for agg.SeenExpiry
+// nor in index.html
+func (agg *Aggregator) saveSeenIndex() error {
+	if agg.ReadOnly {
+		return nil
+	}
+	if agg.SeenExpiry > 0 {
+		// News still in index.html count as seen
+		for _, item := range agg.Items {
+			agg.markKnown(item)
+		}
+		if forgotten := agg.known.forget(dayOf(agg.now().Add(-agg.SeenExpiry))); forgotten > 0 {
+			agg.log.Debugf("forgot %d news not seen for %s", forgotten, agg.SeenExpiry)
+		}
+	}
+	if !agg.known.dirty && agg.known.pages == agg.pages {
+		return nil
+	}
+	if err := agg.checkLease(); err != nil {
+		return err
+	}
+	agg.known.pages = agg.pages
+	agg.known.rules = agg.rulesHash()
+	if err := writeFileAtomically(filepath.Join(agg.Directory, seenIndexFileName), 0, agg.known.writeTo); err != nil {
+		return fmt.Errorf("could not save seen news: %s", err)
+	}
+	agg.known.dirty = false
+	return nil
+}
@@ -0,0 +1,165 @@
+package feed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxStderrLength caps how much of a failed command's stderr ends up in errors, and so in index.html
+const maxStderrLength = 500
+
+// MakeSourceFetcher dispatches feed URLs by scheme so feeds can also come from the local machine:
+// file:///path/to/feed.xml is read from disk and exec:command args runs command and reads its standard output.
+// Any other URL is handed to httpFetcher, usually MakeURLFetcher(). Commands are killed after timeout.
+// Failures are returned as errors just like HTTP ones, with *CommandError carrying the stderr of failed commands.
+func MakeSourceFetcher(log *logrus.Logger, timeout time.Duration, httpFetcher Fetcher) Fetcher {
+	return FetcherFunc(func(ctx context.Context, req Request) (*Response, error) {
+		start := time.Now()
+		var body []byte
+		var err error
+		switch sourceScheme(req.URL) {
+		case "file":
+			body, err = readFileSource(req.URL)
+		case "exec":
+			body, err = runCommandSource(ctx, log, req.URL, timeout)
+		default:
+			return httpFetcher.Fetch(ctx, req)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Response{URL: req.URL, StatusCode: http.StatusOK, Body: body, Duration: time.Since(start)}, nil
+	})
+}
+
+// CommandError is returned by MakeSourceFetcher when an exec: feed fails to run, exits with an error or times out
+type CommandError struct {
+	URL    string
+	Err    error
+	Stderr string
+}
+
+func (err *CommandError) Error() string {
+	msg := fmt.Sprintf("%s failed: %s", err.URL, err.Err)
+	if err.Stderr != "" {
+		msg += ": " + err.Stderr
+	}
+	return msg
+}
+
+func (err *CommandError) Unwrap() error {
+	return err.Err
+}
+
+// sourceScheme returns the lowercased scheme of URL or an empty string if it has none
+func sourceScheme(URL string) string {
+	scheme, _, found := strings.Cut(URL, ":")
+	if !found {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(scheme))
+}
+
+// isLocalSource reports whether URL is a file:// or exec: feed
+func isLocalSource(URL string) bool {
+	scheme := sourceScheme(URL)
+	return scheme == "file" || scheme == "exec"
+}
+
+// readFileSource reads file:///absolute/path, file://localhost/absolute/path or file:relative/path.
+// Relative paths are relative to the working directory.
+func readFileSource(URL string) ([]byte, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", URL, err)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("%s: only local files are supported", URL)
+	}
+	path := u.Path
+	if u.Opaque != "" {
+		if path, err = url.PathUnescape(u.Opaque); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", URL, err)
+		}
+	}
+	return os.ReadFile(path)
+}
+
+// runCommandSource runs the command in exec:command arg1 arg2 and returns its standard output.
+// Arguments are separated by spaces, there's no quoting. Percent-encoded characters are decoded first
+// since index.html stores spaces as %20.
+func runCommandSource(ctx context.Context, log *logrus.Logger, URL string, timeout time.Duration) ([]byte, error) {
+	commandLine, err := url.PathUnescape(strings.TrimSpace(URL[len("exec:"):]))
+	if err != nil {
+		return nil, &CommandError{URL: URL, Err: err}
+	}
+	args := strings.Fields(commandLine)
+	if len(args) == 0 {
+		return nil, &CommandError{URL: URL, Err: errors.New("no command given")}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return nil, &CommandError{URL: URL, Err: err, Stderr: truncateStderr(stderr.String())}
+	}
+	if stderr.Len() > 0 {
+		log.Debugf("%s wrote to stderr: %s", URL, truncateStderr(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func truncateStderr(stderr string) string {
+	stderr = strings.Join(strings.Fields(stderr), " ")
+	if runes := []rune(stderr); len(runes) > maxStderrLength {
+		stderr = string(runes[:maxStderrLength-1]) + "…"
+	}
+	return stderr
+}
+
+// normalizeSourceURL percent-encodes file:// and exec: URLs the way html/template writes them to href attributes,
+// so they keep the same key in Aggregator.Feeds after a trip through index.html. Other URLs are returned as is.
+func normalizeSourceURL(URL string) string {
+	if !isLocalSource(URL) {
+		return URL
+	}
+	var b strings.Builder
+	for i := 0; i < len(URL); i++ {
+		c := URL[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("!#$&*+,/:;=?@[]-._~%", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02x", c)
+	}
+	return b.String()
+}
+
+// TemplateFuncs are available to Tpl. Custom templates must be parsed with them too.
+var TemplateFuncs = template.FuncMap{
+	// feedHref lets file:// and exec: feed URLs through html/template, which would otherwise replace them with #ZgotmplZ
+	"feedHref": func(URL string) interface{} {
+		if isLocalSource(URL) {
+			return template.URL(normalizeSourceURL(URL))
+		}
+		return URL
+	},
+}
@@ -4,7 +4,7 @@ import "html/template"
 
 // Tpl is the default template used to generate index.html and page.html files.
 // Can be customized using -template command-line argument.
-var Tpl = template.Must(template.New("").Parse(`
+var Tpl = template.Must(template.New("").Funcs(TemplateFuncs).Parse(`
 <!DOCTYPE html><html>
 <head>
 <meta charset="UTF-8">
@@ -46,6 +46,47 @@ body {
     background-color: #ddd;
 	font-weight: normal;
 }
+.published {
+	float: right;
+	margin: -4px 5px 0 5px;
+	font-size: 12px;
+	font-weight: normal;
+	color: #666;
+}
+.refreshed {
+	margin-right: 5px;
+	padding: 2px 4px;
+	border-radius: 3px;
+	font-size: 11px;
+	font-weight: normal;
+	color: #fff;
+	background: #873B3B;
+}
+.comments {
+	float: right;
+	position: relative;
+	margin: 1em 0.5em 0 5px;
+	padding: 5px;
+	font-size: 14px;
+	color: #555;
+}
+.related {
+	float: right;
+	position: relative;
+	margin: 1em 0 0 5px;
+	padding: 5px;
+	border: 1px solid #ccc;
+	border-radius: 3px;
+	font-size: 12px;
+	color: #555;
+	text-decoration: none;
+}
+.related:visited {
+	color: #873B3B;
+}
+.comments:visited {
+	color: #873B3B;
+}
 .item:first-child  {
 	border-top: 1px solid #aaa;
 }
@@ -77,13 +118,56 @@ body {
 .feed {
 	display: none;
 }
+.disabled-feed {
+	padding: 0.5em;
+	margin-bottom: 0.5em;
+	color: #fff;
+	background: #873B3B;
+	text-align: left;
+}
+.disabled-feed a {
+	color: #fff;
+}
 </style>
 </head>
 <body>
 {{range $url, $title := .Feeds}}
-<a class="feed" href="{{$url}}">{{$title}}</a>{{end}}
-<div class="container">{{range .Items}}
-<a class="item" target="_blank" href="{{.URL}}">{{if .Tag}}<div class="tag">{{.Tag}}</div>{{end}}{{.Title}}</a>{{end}}
+<a class="feed" href="{{feedHref $url}}"{{with index $.FeedInfos $url}}
+	{{- if .ETag}} data-etag="{{.ETag}}"{{end}}
+	{{- if .LastModified}} data-last-modified="{{.LastModified}}"{{end}}
+	{{- if .Failures}} data-failures="{{.Failures}}" data-last-error="{{.LastError}}"{{end}}
+	{{- if not .LastSuccess.IsZero}} data-last-success="{{.LastSuccess.Format "2006-01-02T15:04:05Z07:00"}}"{{end}}
+	{{- if not .RetryAt.IsZero}} data-retry-at="{{.RetryAt.Format "2006-01-02T15:04:05Z07:00"}}"{{end}}
+	{{- if .Disabled}} data-disabled="true"{{end}}
+	{{- if .Gone}} data-gone="true"{{end}}
+	{{- if .Hints.TTL}} data-ttl="{{.Hints.TTL}}"{{end}}
+	{{- if .Hints.SkipHours}} data-skip-hours="{{range $i, $hour := .Hints.SkipHours}}{{if $i}},{{end}}{{$hour}}{{end}}"{{end}}
+	{{- if .Hints.SkipDays}} data-skip-days="{{range $i, $day := .Hints.SkipDays}}{{if $i}},{{end}}{{$day}}{{end}}"{{end}}
+	{{- if .Interval}} data-interval="{{.Interval}}"{{end}}
+	{{- if .PreferDiscussion}} data-link="discussion"{{end}}
+	{{- with .Scrape}} data-scrape-item="{{.Item}}"{{if .Title}} data-scrape-title="{{.Title}}"{{end}}{{if .Link}} data-scrape-link="{{.Link}}"{{end}}{{if .Date}} data-scrape-date="{{.Date}}"{{end}}{{end}}
+	{{- if not .NextFetch.IsZero}} data-next-fetch="{{.NextFetch.Format "2006-01-02T15:04:05Z07:00"}}"{{end}}
+{{- end}}>{{$title}}</a>{{end}}
+<div class="container">
+{{- range $url, $title := .Feeds}}{{with index $.FeedInfos $url}}{{if .Disabled}}
+<div class="disabled-feed">{{if .Gone}}Gone for good{{else}}Disabled after {{.Failures}} failures{{end}}: <a href="{{feedHref $url}}">{{$title}}</a> {{.LastError}}</div>{{end}}{{end}}{{end}}
+{{- range .Items}}
+{{if .DiscussionURL}}<a class="comments" target="_blank" href="{{if .DiscussionFirst}}{{.URL}}{{else}}{{.DiscussionURL}}{{end}}">{{if .DiscussionFirst}}article{{else}}comments{{end}}</a>{{end}}
+{{- range .Related}}<a class="related" target="_blank" href="{{.URL}}" title="{{.Title}}"{{if .Feed}} data-feed="{{.Feed}}"{{end}}>{{.Tag}}</a>{{end}}
+<a class="item" target="_blank"
+	{{- if .DiscussionFirst}} href="{{.DiscussionURL}}" data-article="{{.URL}}"
+	{{- else}} href="{{.URL}}"{{if .DiscussionURL}} data-discussion="{{.DiscussionURL}}"{{end}}{{end}}
+	{{- if .Summary}} title="{{.Summary}}"{{end}}
+	{{- if .Feed}} data-feed="{{.Feed}}"{{end}}
+	{{- if .Author}} data-author="{{.Author}}"{{end}}
+	{{- if .GUID}} data-guid="{{.GUID}}"{{end}}
+	{{- if not .UpdatedAt.IsZero}} data-updated="{{.UpdatedAt.Format "2006-01-02T15:04:05Z07:00"}}"{{end}}
+	{{- if not .FirstSeen.IsZero}} data-first-seen="{{.FirstSeen.Format "2006-01-02T15:04:05Z07:00"}}"{{end}}
+	{{- if not .RefreshedAt.IsZero}} data-refreshed="{{.RefreshedAt.Format "2006-01-02T15:04:05Z07:00"}}"{{end}}>
+	{{- if .Tag}}<div class="tag">{{.Tag}}</div>{{end}}
+	{{- if not .PublishedAt.IsZero}}<time class="published" datetime="{{.PublishedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.PublishedAt.Format "Jan 2"}}</time>{{end}}
+	{{- if not .RefreshedAt.IsZero}}<span class="refreshed">updated</span>{{end}}
+	{{- .Title}}</a>{{end}}
 {{if gt .NextPage 1}}<a class="next" href="page{{.NextPage}}.html">Next</a>{{end}}
 </div>
 
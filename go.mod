@@ -9,6 +9,8 @@ require (
 	github.com/kennygrant/sanitize v1.2.4
 	github.com/mmcdole/gofeed v1.2.1
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/net v0.7.0
+	golang.org/x/text v0.7.0
 )
 
 require (
@@ -17,7 +19,5 @@ require (
 	github.com/mmcdole/goxpp v1.1.0 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
-	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
-	golang.org/x/text v0.7.0 // indirect
 )
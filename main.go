@@ -7,27 +7,47 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/ww9/news/feed"
 )
 
+var flagCluster = flag.Int("cluster", 48, "hours during which news from different feeds with similar titles are shown as one entry. News sharing a link always are. 0 only groups by link")
 var flagDir = flag.String("dir", "", "directory to store html files. By default ./news is used and created if necessary")
-var flagTimeout = flag.Int("timeout", 10, "timeout in seconds when fetching feeds")
-var flagUpdateInterval = flag.Int("wait", 10, "minutes to wait between updates")
+var flagTakeover = flag.Bool("takeover", false, "take -dir over from an instance on another machine which stopped renewing its lease, such as one that crashed")
+var flagTimeout = flag.Int("timeout", 10, "timeout in seconds when fetching feeds, including exec: feeds")
+var flagUpdateInterval = flag.Int("wait", 10, "minutes to wait between updates of feeds without refresh hints. Feeds can set their own with data-interval in index.html")
+var flagMinFeedInterval = flag.Int("minwait", 10, "minimum minutes between fetches of the same feed, even if its publisher asks for less (RSS <ttl> and similar)")
+var flagMaxFeedInterval = flag.Int("maxwait", 24*60, "maximum minutes between fetches of the same feed, even if its publisher asks for more (RSS <ttl> and similar)")
+var flagForget = flag.Int("forget", 0, "days after which news no longer in index.html nor in their feed are forgotten, so the list of seen news doesn't grow forever. Forgotten news show up again if their feed brings them back. 0 never forgets")
 var flagItemsPerPage = flag.Int("items", 500, "number of items per page.html file. A new page.html file is created whenever index.html contains 2x that number")
 var flagVerbose = flag.Bool("verbose", false, "verbose mode outputs extra info when enabled")
 var flagTemplateFile = flag.String("template", "", "custom Go html/template file to use when generating .html files. See `news/feed/template.go`")
 var flagOPMLFile = flag.String("opml", "", "path to OPML file containing feed URLS to be imported. Existing feed URLs are ovewritten, not duplicated")
 var flagMinDomainRequestInterval = flag.Int("noflood", 30, "minium seconds between calls to same domain to avoid flooding")
+var flagMaxFailures = flag.Int("maxfailures", 20, "consecutive failed fetches after which a feed is disabled. Failing feeds are retried less and less often until then. 0 never disables feeds")
+var flagChronological = flag.Bool("chronological", false, "sort news found in each update by date instead of grouping them by feed")
+var flagRefresh = flag.String("refresh", "", "update news already in index.html in place when their feed changes the title or update time: quiet or mark, which also labels them as updated. By default news are never touched once saved")
+var flagReadOnly = flag.Bool("readonly", false, "run alongside the instance writing to -dir, such as one on another machine sharing it through Google Drive or Dropbox, fetching feeds and logging news without writing anything")
+var flagRecord = flag.String("record", "", "directory to record every fetched response to, along with index.html from before the update. Runs a single update and exits")
+var flagReplay = flag.String("replay", "", "directory recorded with -record to replay without network. Runs a single update and exits. Results go to -dir, which must not have an index.html yet and defaults to the output directory inside the recording")
+var flagURLRules = flag.String("urlrules", "", "path to file with per-domain rules for cleaning item URLs, one domain per line such as: example.com keep=id strip=ref,source")
+var flagWorkers = flag.Int("workers", 4, "number of feeds fetched concurrently. Feeds from the same domain are still fetched one at a time")
 
 func main() {
 	flag.Parse()
 	*flagTimeout = minMax(*flagTimeout, 1, 60)
 	*flagItemsPerPage = minMax(*flagItemsPerPage, 2, 500)
 	*flagUpdateInterval = minMax(*flagUpdateInterval, 1, 24*60)
+	*flagMinFeedInterval = minMax(*flagMinFeedInterval, 1, 24*60)
+	*flagMaxFeedInterval = minMax(*flagMaxFeedInterval, *flagMinFeedInterval, 30*24*60)
 	*flagMinDomainRequestInterval = minMax(*flagMinDomainRequestInterval, 10, 24*60*60)
+	*flagWorkers = minMax(*flagWorkers, 1, 64)
+	*flagMaxFailures = minMax(*flagMaxFailures, 0, 1000)
+	*flagCluster = minMax(*flagCluster, 0, 30*24)
+	*flagForget = minMax(*flagForget, 0, 100*365)
 
 	log := logrus.New()
 	log.SetLevel(logrus.InfoLevel)
@@ -36,25 +56,92 @@ func main() {
 	}
 
 	if *flagTemplateFile != "" {
-		tpl, err := template.ParseFiles(*flagTemplateFile)
+		tpl, err := template.New(filepath.Base(*flagTemplateFile)).Funcs(feed.TemplateFuncs).ParseFiles(*flagTemplateFile)
 		if err != nil {
 			log.Fatalf("Could not load custom template file: %s", err)
 		}
 		feed.Tpl = tpl
 	}
-	agg, err := feed.NewWithCustom(
+	fetcher := feed.MakeSourceFetcher(
 		log,
-		*flagDir,
-		*flagItemsPerPage,
+		time.Second*time.Duration(*flagTimeout),
 		feed.MakeURLFetcher(
 			log,
 			time.Second*time.Duration(*flagMinDomainRequestInterval),
 			&http.Client{Timeout: time.Second * time.Duration(*flagTimeout)},
 		),
 	)
+	if *flagReplay != "" {
+		var err error
+		if fetcher, err = feed.Replay(*flagReplay); err != nil {
+			log.Fatalf("Could not load recording: %s", err)
+		}
+		if *flagDir == "" {
+			*flagDir = filepath.Join(*flagReplay, "output")
+		}
+		// Replaying starts from the recorded index.html, so it must not land on top of real news
+		if _, err := os.Stat(filepath.Join(*flagDir, "index.html")); err == nil {
+			log.Fatalf("%s already has an index.html. Replay into a new directory or remove it first", *flagDir)
+		}
+		if err := os.MkdirAll(*flagDir, 0755); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *flagRecord != "" {
+		if err := os.MkdirAll(*flagRecord, 0755); err != nil {
+			log.Fatalln(err)
+		}
+		fetcher = feed.Chain(fetcher, feed.Record(log, *flagRecord))
+	}
+	// URL rules go in before the html files are loaded, so known news aren't reindexed under the default ones first
+	var rules map[string]feed.URLRule
+	if *flagURLRules != "" {
+		f, err := os.Open(*flagURLRules)
+		if err != nil {
+			log.Fatalf("Could not open URL rules file: %s", err)
+		}
+		rules, err = feed.ParseURLRules(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Could not read URL rules file %s: %s", *flagURLRules, err)
+		}
+	}
+	lockMode := feed.Exclusive
+	if *flagTakeover {
+		lockMode = feed.TakeOver
+	}
+	if *flagReadOnly {
+		lockMode = feed.ReadOnly
+	}
+	agg, err := feed.NewWithRules(log, *flagDir, *flagItemsPerPage, fetcher, lockMode, rules)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer agg.Close()
+	// log.Fatal skips deferred calls, which would leave the lease behind for other machines to wait out
+	logrus.RegisterExitHandler(agg.Close)
+	if *flagReplay != "" {
+		if err := agg.LoadRecordedIndex(*flagReplay); err != nil {
+			log.Fatalf("Could not load recorded index.html: %s", err)
+		}
+	}
+	agg.Workers = *flagWorkers
+	agg.Chronological = *flagChronological
+	agg.ClusterWindow = time.Duration(*flagCluster) * time.Hour
+	agg.SeenExpiry = time.Duration(*flagForget) * 24 * time.Hour
+	switch *flagRefresh {
+	case "":
+	case "quiet", "mark":
+		agg.RefreshKnownItems = true
+		agg.MarkRefreshed = *flagRefresh == "mark"
+	default:
+		log.Fatalf("-refresh must be quiet or mark but found %q", *flagRefresh)
+	}
+	agg.MaxFailures = *flagMaxFailures
+	agg.FailureBackoff = time.Duration(*flagUpdateInterval) * time.Minute
+	agg.DefaultInterval = time.Duration(*flagUpdateInterval) * time.Minute
+	agg.MinInterval = time.Duration(*flagMinFeedInterval) * time.Minute
+	agg.MaxInterval = time.Duration(*flagMaxFeedInterval) * time.Minute
 	if *flagOPMLFile != "" {
 		importedFeeds, err := agg.ImportOPMLFile(*flagOPMLFile)
 		if err != nil {
@@ -64,14 +151,30 @@ func main() {
 		}
 	}
 
+	if *flagReplay != "" {
+		recordedAt, err := feed.RecordedAt(*flagReplay)
+		if err != nil {
+			log.Fatalf("Could not load recording: %s", err)
+		}
+		agg.Clock = func() time.Time { return recordedAt }
+		agg.Shuffle = false
+	}
+	if *flagRecord != "" {
+		if err := copyFile(filepath.Join(agg.Directory, "index.html"), filepath.Join(*flagRecord, "index.html")); err != nil {
+			log.Fatalf("Could not record index.html: %s", err)
+		}
+	}
+	if *flagRecord != "" || *flagReplay != "" {
+		if err := agg.Update(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Infof("Done. Results are in %s", agg.Directory)
+		return
+	}
+
 	go func() {
-		for {
-			log.Infof("Fetching news from %d feed sources...", len(agg.Feeds))
-			if err := agg.Update(); err != nil {
-				log.Fatalln(err)
-			}
-			log.Infof("Done. Waiting %d minutes for next update...", *flagUpdateInterval)
-			time.Sleep(time.Duration(*flagUpdateInterval) * time.Minute)
+		if err := agg.Run(nil); err != nil {
+			log.Fatalln(err)
 		}
 	}()
 
@@ -89,6 +192,14 @@ func pressCTRLCToExit() {
 	<-exitCh
 }
 
+func copyFile(src, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, content, 0644)
+}
+
 func minMax(value int, min int, max int) int {
 	if value < min {
 		return min